@@ -0,0 +1,63 @@
+package traefikretryplugin
+
+import (
+	"net/http"
+	"time"
+)
+
+// Attempt describes a single call to the upstream.
+type Attempt struct {
+	Number int
+	// PrevDelay is the wait before the attempt.
+	PrevDelay time.Duration
+	// Deadline is the time no attempt may start after, zero means no deadline.
+	Deadline time.Time
+	// Trace follows the connection to the upstream, nil when failures aren't classified.
+	Trace *AttemptTrace
+	// TimedOut reports the expiry of the per-try timeout, nil when there is no timeout.
+	TimedOut func() bool
+	// Budget is spent by retrying the attempt, nil when retries aren't limited.
+	Budget *RetryBudget
+	// Breaker accounts the outcome of the attempt, nil when there is no circuit breaker.
+	Breaker *CircuitBreaker
+	// Info describes the retries in the committed response, nil when it's not annotated.
+	Info *RetryInfo
+	// Body inspects the body of the acceptable responses, nil when the bodies aren't inspected.
+	Body *BodyPredicate
+	// BufferSize limits the response held to be inspected, larger responses are committed as they are.
+	BufferSize int64
+	// GRPC tells the attempt is a call of the gRPC mode, which grpc-status may come in the trailers.
+	GRPC bool
+	// GRPCOnly restricts the retries to the grpc-status, for the calls which method the policy excludes.
+	GRPCOnly bool
+}
+
+func (a Attempt) timedOut() bool {
+	return a.TimedOut != nil && a.TimedOut()
+}
+
+func (a Attempt) startsBefore(delay time.Duration) bool {
+	return a.Deadline.IsZero() || time.Now().Add(delay).Before(a.Deadline)
+}
+
+// classify tells whether the response of the attempt is a failure according to the policy, and why:
+// the per try timeout, the transport failure, the grpc-status, the header or the status.
+func (a Attempt) classify(p *RetryPolicy, status int, header http.Header) (bool, string) {
+	if a.timedOut() {
+		return true, reasonTimeout
+	}
+
+	if f := a.Trace.Classify(status, header); f != FailureNone && p.HandlesFailures() {
+		return p.RetriesOn(f), f.String()
+	}
+
+	if p.RetriesOnGRPC(header, nil) {
+		return true, reasonGRPC
+	}
+
+	if p.MatchesHeaders(header) {
+		return true, reasonHeader
+	}
+
+	return p.Applicable(status), reasonStatus
+}
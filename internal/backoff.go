@@ -0,0 +1,166 @@
+package traefikretryplugin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Jitter int
+
+const (
+	JitterNone Jitter = iota
+	JitterFull
+	JitterEqual
+	JitterDecorrelated
+)
+
+var jitterNames = map[Jitter]string{
+	JitterNone:         "none",
+	JitterFull:         "full",
+	JitterEqual:        "equal",
+	JitterDecorrelated: "decorrelated",
+}
+
+func (j Jitter) String() string {
+	return jitterNames[j]
+}
+
+func ParseJitter(s string) (Jitter, error) {
+	if s == "" {
+		return JitterNone, nil
+	}
+
+	for j, name := range jitterNames {
+		if strings.EqualFold(s, name) {
+			return j, nil
+		}
+	}
+
+	return JitterNone, fmt.Errorf("traefikretryplugin.ParseJitter: unknown jitter `%s`", s)
+}
+
+const (
+	defaultMultiplier = 2
+	// defaultMaxDelay caps the delay when the backoff has no max, so that a large number of attempts
+	// can't make the retry loop wait for hours
+	defaultMaxDelay = 30 * time.Second
+	// maxDelayLimit is the largest max accepted, the header may come from any client
+	maxDelayLimit = 5 * time.Minute
+)
+
+type Backoff struct {
+	initial    time.Duration
+	multiplier float64
+	max        time.Duration
+	jitter     Jitter
+}
+
+// ParseBackoff reads the backoff from the "initial [multiplier [max]]" notation,
+// eg: `100ms 2 5s`. Multiplier defaults to 2 and max to 30s.
+func ParseBackoff(s string) (Backoff, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Backoff{}, nil
+	}
+
+	if len(fields) > 3 {
+		return Backoff{}, errors.New("traefikretryplugin.ParseBackoff: too many fields")
+	}
+
+	b := Backoff{multiplier: defaultMultiplier, max: defaultMaxDelay}
+
+	var err error
+
+	b.initial, err = time.ParseDuration(fields[0])
+	if err != nil {
+		return Backoff{}, fmt.Errorf("traefikretryplugin.ParseBackoff: can't parse initial delay: %w", err)
+	}
+
+	if len(fields) > 1 {
+		b.multiplier, err = strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return Backoff{}, fmt.Errorf("traefikretryplugin.ParseBackoff: can't parse multiplier: %w", err)
+		}
+	}
+
+	if len(fields) > 2 {
+		b.max, err = time.ParseDuration(fields[2])
+		if err != nil {
+			return Backoff{}, fmt.Errorf("traefikretryplugin.ParseBackoff: can't parse max delay: %w", err)
+		}
+	}
+
+	if b.initial < 0 || b.max <= 0 || b.max > maxDelayLimit || b.multiplier < 1 {
+		return Backoff{}, fmt.Errorf("traefikretryplugin.ParseBackoff: backoff `%s` is invalid", s)
+	}
+
+	return b, nil
+}
+
+func (b Backoff) WithJitter(j Jitter) Backoff {
+	b.jitter = j
+
+	return b
+}
+
+// Delay returns the wait before the attempt following the given one.
+// The previous delay is only used by the decorrelated jitter.
+func (b Backoff) Delay(attempt int, prev time.Duration) time.Duration {
+	if b.initial == 0 {
+		return 0
+	}
+
+	if b.jitter == JitterDecorrelated {
+		if prev < b.initial {
+			prev = b.initial
+		}
+
+		// prev is bounded by the max, which keeps 3*prev from overflowing
+		if prev > b.max {
+			prev = b.max
+		}
+
+		return b.capped(b.initial + randDuration(3*prev-b.initial))
+	}
+
+	d := b.capped(time.Duration(float64(b.initial) * math.Pow(b.multiplier, float64(attempt))))
+
+	switch b.jitter {
+	case JitterFull:
+		return randDuration(d)
+	case JitterEqual:
+		return d/2 + randDuration(d/2)
+	default:
+		return d
+	}
+}
+
+func (b Backoff) capped(d time.Duration) time.Duration {
+	// float64 to Duration conversion overflows into negative values
+	if d < 0 || d > b.max {
+		return b.max
+	}
+
+	return d
+}
+
+func (b Backoff) String() string {
+	if b.initial == 0 {
+		return "none"
+	}
+
+	return fmt.Sprintf("%s %g %s (jitter: %s)", b.initial, b.multiplier, b.max, b.jitter)
+}
+
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
@@ -0,0 +1,105 @@
+package traefikretryplugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBackoff(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+		err  bool
+	}{
+		{spec: "", want: "none"},
+		{spec: "100ms", want: "100ms 2 30s (jitter: none)"},
+		{spec: "100ms 1.5", want: "100ms 1.5 30s (jitter: none)"},
+		{spec: "100ms 3 5s", want: "100ms 3 5s (jitter: none)"},
+		{spec: "1s 2 5m", want: "1s 2 5m0s (jitter: none)"},
+		{spec: "1s 2 5m1s", err: true},
+		{spec: "1s 2 0s", err: true},
+		{spec: "1s 2 -1s", err: true},
+		{spec: "1s 0.5", err: true},
+		{spec: "-1s", err: true},
+		{spec: "1s 2 5s 1", err: true},
+		{spec: "soon", err: true},
+		{spec: "1s twice", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			b, err := ParseBackoff(tt.spec)
+			if (err != nil) != tt.err {
+				t.Fatalf("ParseBackoff(%q) = %v", tt.spec, err)
+			}
+
+			if err == nil && b.String() != tt.want {
+				t.Errorf("String() = %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b, err := ParseBackoff("100ms 2 1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt, want := range []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second,
+	} {
+		if d := b.Delay(attempt, 0); d != want {
+			t.Errorf("Delay(%d) = %s, want %s", attempt, d, want)
+		}
+	}
+
+	// the delay overflowing the duration is capped too
+	if d := b.Delay(10000, 0); d != time.Second {
+		t.Errorf("Delay(10000) = %s, want the max", d)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b, err := ParseBackoff("100ms 2 1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		jitter   Jitter
+		attempt  int
+		prev     time.Duration
+		min, max time.Duration
+	}{
+		{jitter: JitterFull, attempt: 2, min: 0, max: 400 * time.Millisecond},
+		{jitter: JitterEqual, attempt: 2, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{jitter: JitterDecorrelated, prev: 0, min: 100 * time.Millisecond, max: 300 * time.Millisecond},
+		{jitter: JitterDecorrelated, prev: 200 * time.Millisecond, min: 100 * time.Millisecond, max: 600 * time.Millisecond},
+		{jitter: JitterDecorrelated, prev: time.Hour, min: 100 * time.Millisecond, max: time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.jitter.String(), func(t *testing.T) {
+			jb := b.WithJitter(tt.jitter)
+
+			for i := 0; i < 1000; i++ {
+				if d := jb.Delay(tt.attempt, tt.prev); d < tt.min || d > tt.max {
+					t.Fatalf("Delay(%d, %s) = %s, want within [%s %s]", tt.attempt, tt.prev, d, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestParseJitter(t *testing.T) {
+	for s, want := range map[string]Jitter{"": JitterNone, "full": JitterFull, "Equal": JitterEqual, "decorrelated": JitterDecorrelated} {
+		if j, err := ParseJitter(s); err != nil || j != want {
+			t.Errorf("ParseJitter(%q) = %s, %v, want %s", s, j, err, want)
+		}
+	}
+
+	if _, err := ParseJitter("random"); err == nil {
+		t.Error("ParseJitter(random) accepted")
+	}
+}
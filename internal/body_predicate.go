@@ -0,0 +1,123 @@
+package traefikretryplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BodyPredicate tells whether the response body makes an attempt retryable. A nil predicate inspects nothing.
+type BodyPredicate struct {
+	contains []byte
+	regex    *regexp.Regexp
+	pointer  []string
+	value    interface{}
+}
+
+// NewBodyPredicate compiles the predicates, any of which matching makes the attempt retryable.
+// The JSON predicate compares the value at the pointer with a JSON literal, eg: /errors/0/code == "UNAVAILABLE".
+func NewBodyPredicate(contains, regex, jsonPointer string) (*BodyPredicate, error) {
+	bp := &BodyPredicate{}
+
+	if contains != "" {
+		bp.contains = []byte(contains)
+	}
+
+	if regex != "" {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.NewBodyPredicate: %w", err)
+		}
+
+		bp.regex = re
+	}
+
+	if jsonPointer != "" {
+		pointer, literal, ok := strings.Cut(jsonPointer, "==")
+		if !ok {
+			return nil, fmt.Errorf("traefikretryplugin.NewBodyPredicate: `%s` is not a comparison", jsonPointer)
+		}
+
+		tokens, err := parsePointer(strings.TrimSpace(pointer))
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.NewBodyPredicate: %w", err)
+		}
+
+		if err = json.Unmarshal([]byte(strings.TrimSpace(literal)), &bp.value); err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.NewBodyPredicate: can't parse value: %w", err)
+		}
+
+		bp.pointer = tokens
+	}
+
+	return bp, nil
+}
+
+func (bp *BodyPredicate) Match(body []byte) bool {
+	if bp.contains != nil && bytes.Contains(body, bp.contains) {
+		return true
+	}
+
+	if bp.regex != nil && bp.regex.Match(body) {
+		return true
+	}
+
+	if bp.pointer != nil {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return false
+		}
+
+		v, ok := resolvePointer(doc, bp.pointer)
+
+		return ok && reflect.DeepEqual(v, bp.value)
+	}
+
+	return false
+}
+
+// parsePointer splits the RFC 6901 JSON pointer into the reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return []string{}, nil
+	}
+
+	if p[0] != '/' {
+		return nil, fmt.Errorf("traefikretryplugin.parsePointer: pointer `%s` must start with /", p)
+	}
+
+	tokens := strings.Split(p[1:], "/")
+
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+func resolvePointer(doc interface{}, tokens []string) (interface{}, bool) {
+	for _, t := range tokens {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = v[t]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(t)
+			if err != nil || i < 0 || i >= len(v) || t != strconv.Itoa(i) {
+				return nil, false
+			}
+
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
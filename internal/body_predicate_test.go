@@ -0,0 +1,156 @@
+package traefikretryplugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewBodyPredicate(t *testing.T) {
+	tests := []struct {
+		name        string
+		contains    string
+		regex       string
+		jsonPointer string
+	}{
+		{name: "regex", regex: "("},
+		{name: "no comparison", jsonPointer: "/code"},
+		{name: "relative pointer", jsonPointer: `code == "x"`},
+		{name: "not a literal", jsonPointer: "/code == UNAVAILABLE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewBodyPredicate(tt.contains, tt.regex, tt.jsonPointer); err == nil {
+				t.Error("NewBodyPredicate() doesn't fail")
+			}
+		})
+	}
+}
+
+func TestParsePointer(t *testing.T) {
+	tests := []struct {
+		pointer string
+		tokens  []string
+	}{
+		{pointer: "", tokens: []string{}},
+		{pointer: "/", tokens: []string{""}},
+		{pointer: "/errors/0/code", tokens: []string{"errors", "0", "code"}},
+		{pointer: "/a~1b/c~0d", tokens: []string{"a/b", "c~d"}},
+		// ~01 is the escaped ~ followed by 1, not the escaped /
+		{pointer: "/~01", tokens: []string{"~1"}},
+	}
+
+	for _, tt := range tests {
+		tokens, err := parsePointer(tt.pointer)
+		if err != nil || !reflect.DeepEqual(tokens, tt.tokens) {
+			t.Errorf("parsePointer(%q) = %q, %v, want %q", tt.pointer, tokens, err, tt.tokens)
+		}
+	}
+}
+
+func TestBodyPredicateMatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contains    string
+		regex       string
+		jsonPointer string
+		body        string
+		match       bool
+	}{
+		{name: "contains", contains: "overloaded", body: `{"error":"overloaded"}`, match: true},
+		{name: "doesn't contain", contains: "overloaded", body: `{"error":"not found"}`},
+		{name: "regex", regex: `"retry":\s*true`, body: `{"retry": true}`, match: true},
+		{name: "string", jsonPointer: `/errors/0/code == "UNAVAILABLE"`, body: `{"errors":[{"code":"UNAVAILABLE"}]}`, match: true},
+		{name: "other string", jsonPointer: `/errors/0/code == "UNAVAILABLE"`, body: `{"errors":[{"code":"INTERNAL"}]}`},
+		{name: "number", jsonPointer: "/code == 503", body: `{"code":503.0}`, match: true},
+		{name: "number as string", jsonPointer: "/code == 503", body: `{"code":"503"}`},
+		{name: "string as number", jsonPointer: `/code == "503"`, body: `{"code":503}`},
+		{name: "boolean", jsonPointer: "/retry == true", body: `{"retry":true}`, match: true},
+		{name: "null", jsonPointer: "/error == null", body: `{"error":null}`, match: true},
+		{name: "missing null", jsonPointer: "/error == null", body: `{}`},
+		{name: "object", jsonPointer: `/error == {"code":1}`, body: `{"error":{"code":1}}`, match: true},
+		{name: "whole document", jsonPointer: `== "down"`, body: `"down"`, match: true},
+		{name: "escaped tokens", jsonPointer: "/a~1b/c~0d == 1", body: `{"a/b":{"c~d":1}}`, match: true},
+		{name: "second element", jsonPointer: "/errors/1 == 2", body: `{"errors":[1,2]}`, match: true},
+		{name: "index out of range", jsonPointer: "/errors/2 == 2", body: `{"errors":[1,2]}`},
+		{name: "leading zero index", jsonPointer: "/errors/01 == 2", body: `{"errors":[1,2]}`},
+		{name: "end of array", jsonPointer: "/errors/- == 2", body: `{"errors":[1,2]}`},
+		{name: "index of object", jsonPointer: "/errors/0 == 1", body: `{"errors":{"0":1}}`, match: true},
+		{name: "through a scalar", jsonPointer: "/code/0 == 1", body: `{"code":1}`},
+		{name: "not JSON", jsonPointer: "/code == 1", body: "code=1"},
+		{name: "none", body: "anything"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bp, err := NewBodyPredicate(tt.contains, tt.regex, tt.jsonPointer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := bp.Match([]byte(tt.body)); got != tt.match {
+				t.Errorf("Match(%s) = %v, want %v", tt.body, got, tt.match)
+			}
+		})
+	}
+}
+
+func TestBodyHeld(t *testing.T) {
+	bp, err := NewBodyPredicate("overloaded", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2})
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     string
+		flush    bool
+		retrying bool
+	}{
+		{name: "matching", body: "overloaded", retrying: true},
+		{name: "not matching", body: "ok"},
+		{name: "over the buffer", body: "overloaded, and then some"},
+		{name: "flushed", body: "overloaded", flush: true},
+		{name: "encoded", encoding: "gzip", body: "overloaded"},
+		{name: "identity", encoding: "identity", body: "overloaded", retrying: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rrw := NewRetryResponseWriter(rec, pl, Attempt{Body: bp, BufferSize: 16})
+			w := rrw.Writer()
+
+			if tt.encoding != "" {
+				w.Header().Set("Content-Encoding", tt.encoding)
+			}
+
+			w.Header().Set("X-Upstream", "1")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(tt.body))
+
+			if tt.flush {
+				w.(http.Flusher).Flush()
+			}
+
+			rrw.Finish()
+
+			if rrw.Retrying != tt.retrying {
+				t.Fatalf("retrying %v, want %v", rrw.Retrying, tt.retrying)
+			}
+
+			if tt.retrying && (rec.Body.Len() > 0 || rec.Header().Get("X-Upstream") != "") {
+				t.Errorf("the retried attempt leaked body %q, header %v", rec.Body.String(), rec.Header())
+			}
+
+			if !tt.retrying && (rec.Code != http.StatusOK || rec.Body.String() != tt.body || rec.Header().Get("X-Upstream") != "1") {
+				t.Errorf("status %d, body %q, header %v, want the attempt committed", rec.Code, rec.Body.String(), rec.Header())
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package traefikretryplugin
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+const (
+	breakerSuccesses = iota
+	breakerFailures
+)
+
+type BreakerMode int
+
+const (
+	// BreakerDisableRetries lets the requests through without retries while the breaker isn't closed.
+	BreakerDisableRetries BreakerMode = iota
+	// BreakerFailFast rejects the requests while the breaker is open, and all but the probes while it's half-open.
+	BreakerFailFast
+)
+
+func ParseBreakerMode(s string) (BreakerMode, error) {
+	switch s {
+	case "", "disable-retries":
+		return BreakerDisableRetries, nil
+	case "fail-fast":
+		return BreakerFailFast, nil
+	default:
+		return BreakerDisableRetries, fmt.Errorf("traefikretryplugin.ParseBreakerMode: unknown mode `%s`", s)
+	}
+}
+
+type BreakerConfig struct {
+	Mode BreakerMode
+	// FailureRatio of the attempts within the window opens the breaker.
+	FailureRatio float64
+	// MinAttempts within the window are needed to open the breaker.
+	MinAttempts int
+	Window      time.Duration
+	// OpenDuration passes before the breaker lets the probes through.
+	OpenDuration time.Duration
+	// Probes is the number of successful attempts closing the half-open breaker.
+	Probes int
+}
+
+// CircuitBreaker follows the outcomes of the attempts of the plugin instance. A nil breaker is always closed.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	config   BreakerConfig
+	state    breakerState
+	window   window
+	openedAt time.Time
+	probing  int
+	probed   int
+}
+
+func NewCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		config: config,
+		window: newWindow(config.Window),
+	}
+}
+
+// Allow tells whether the request may be served at all.
+func (b *CircuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.halfOpen(time.Now())
+
+	if b.config.Mode != BreakerFailFast {
+		return true
+	}
+
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if b.probing >= b.config.Probes {
+			return false
+		}
+
+		b.probing++
+	}
+
+	return true
+}
+
+// Release gives back the probe allowed to a request that didn't reach the upstream.
+func (b *CircuitBreaker) Release() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen && b.probing > 0 {
+		b.probing--
+	}
+}
+
+// AllowsRetries tells whether failed attempts may be retried.
+func (b *CircuitBreaker) AllowsRetries() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.halfOpen(time.Now())
+
+	return b.state == breakerClosed
+}
+
+// Record accounts the outcome of an attempt.
+func (b *CircuitBreaker) Record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	switch b.state {
+	case breakerClosed:
+		if failed {
+			b.window.add(now, breakerFailures)
+		} else {
+			b.window.add(now, breakerSuccesses)
+		}
+
+		successes, failures := b.window.sums(now)
+		total := successes + failures
+
+		if total >= b.config.MinAttempts && float64(failures) >= b.config.FailureRatio*float64(total) {
+			b.open(now)
+		}
+	case breakerHalfOpen:
+		if b.probing > 0 {
+			b.probing--
+		}
+
+		if failed {
+			b.open(now)
+			return
+		}
+
+		b.probed++
+
+		if b.probed >= b.config.Probes {
+			b.state = breakerClosed
+			b.window.reset()
+		}
+	}
+}
+
+func (b *CircuitBreaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.probing = 0
+	b.probed = 0
+}
+
+func (b *CircuitBreaker) halfOpen(now time.Time) {
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= b.config.OpenDuration {
+		b.state = breakerHalfOpen
+	}
+}
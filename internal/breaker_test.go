@@ -0,0 +1,61 @@
+package traefikretryplugin
+
+import (
+	"testing"
+	"time"
+)
+
+func newHalfOpenBreaker(t *testing.T) *CircuitBreaker {
+	t.Helper()
+
+	b := NewCircuitBreaker(BreakerConfig{
+		Mode:         BreakerFailFast,
+		FailureRatio: 0.5,
+		MinAttempts:  1,
+		Window:       time.Second,
+		OpenDuration: time.Millisecond,
+		Probes:       1,
+	})
+
+	b.Record(true)
+
+	if b.Allow() {
+		t.Fatal("the open breaker allowed a request")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	return b
+}
+
+func TestBreakerProbe(t *testing.T) {
+	b := newHalfOpenBreaker(t)
+
+	if !b.Allow() {
+		t.Fatal("the half-open breaker refused the probe")
+	}
+
+	if b.Allow() {
+		t.Fatal("the half-open breaker allowed more than the probes")
+	}
+
+	b.Record(false)
+
+	if !b.Allow() || !b.AllowsRetries() {
+		t.Error("the successful probe didn't close the breaker")
+	}
+}
+
+func TestBreakerRelease(t *testing.T) {
+	b := newHalfOpenBreaker(t)
+
+	if !b.Allow() {
+		t.Fatal("the half-open breaker refused the probe")
+	}
+
+	b.Release()
+
+	if !b.Allow() {
+		t.Error("the released probe wasn't given back")
+	}
+}
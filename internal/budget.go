@@ -0,0 +1,91 @@
+package traefikretryplugin
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultBudgetWindow = 10 * time.Second
+
+const (
+	budgetRequests = iota
+	budgetRetries
+)
+
+// RetryBudget limits the retries of the plugin instance to a share of the recent requests,
+// with a floor of retries per second, in the manner of Envoy and Finagle retry budgets.
+// A nil budget allows every retry.
+type RetryBudget struct {
+	mu           sync.Mutex
+	ratio        float64
+	minPerSecond int
+	window       window
+}
+
+// NewRetryBudget creates a budget allowing the given percent of the requests within the window to be retried.
+func NewRetryBudget(percent float64, minPerSecond int, d time.Duration) *RetryBudget {
+	if d <= 0 {
+		d = defaultBudgetWindow
+	}
+
+	return &RetryBudget{
+		ratio:        percent / 100,
+		minPerSecond: minPerSecond,
+		window:       newWindow(d),
+	}
+}
+
+// Request accounts a request that may be retried.
+func (b *RetryBudget) Request() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.window.add(time.Now(), budgetRequests)
+}
+
+// Available tells whether a retry fits the budget without spending it.
+func (b *RetryBudget) Available() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.available(time.Now())
+}
+
+// Withdraw spends a retry if it fits the budget.
+func (b *RetryBudget) Withdraw() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	if !b.available(now) {
+		return false
+	}
+
+	b.window.add(now, budgetRetries)
+
+	return true
+}
+
+func (b *RetryBudget) available(now time.Time) bool {
+	requests, retries := b.window.sums(now)
+
+	allowed := b.ratio * float64(requests)
+	if floor := float64(b.minPerSecond * b.window.seconds()); floor > allowed {
+		allowed = floor
+	}
+
+	return float64(retries) < allowed
+}
@@ -0,0 +1,71 @@
+package traefikretryplugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudgetRatio(t *testing.T) {
+	b := NewRetryBudget(20, 0, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		b.Request()
+	}
+
+	for i := 0; i < 2; i++ {
+		if !b.Withdraw() {
+			t.Fatalf("retry %d over the budget, want 2 of the 10 requests allowed", i+1)
+		}
+	}
+
+	if b.Available() || b.Withdraw() {
+		t.Error("the third retry fits the budget")
+	}
+}
+
+func TestBudgetFloor(t *testing.T) {
+	b := NewRetryBudget(10, 1, 3*time.Second)
+
+	// a retry per second of the window, without any request
+	for i := 0; i < 3; i++ {
+		if !b.Withdraw() {
+			t.Fatalf("retry %d over the budget, want the floor of 3", i+1)
+		}
+	}
+
+	if b.Withdraw() {
+		t.Error("the retry over the floor fits the budget")
+	}
+}
+
+func TestBudgetWindow(t *testing.T) {
+	b := NewRetryBudget(0, 1, 2*time.Second)
+	now := time.Now()
+
+	b.window.add(now, budgetRetries)
+	b.window.add(now, budgetRetries)
+
+	if b.available(now) || b.available(now.Add(time.Second)) {
+		t.Error("the spent budget is available within the window")
+	}
+
+	if !b.available(now.Add(2 * time.Second)) {
+		t.Error("the budget isn't available once the retries left the window")
+	}
+
+	b.window.add(now, budgetRequests)
+
+	if r, _ := b.window.sums(now.Add(3 * time.Second)); r != 0 {
+		t.Errorf("%d requests past the window, want none", r)
+	}
+}
+
+func TestBudgetNil(t *testing.T) {
+	var b *RetryBudget
+
+	b.Request()
+
+	if !b.Available() || !b.Withdraw() {
+		t.Error("the nil budget doesn't allow every retry")
+	}
+}
@@ -0,0 +1,228 @@
+package traefikretryplugin
+
+import (
+	"fmt"
+	. "github.com/atidev/golib/pkg/intervals"
+	"strconv"
+	"strings"
+)
+
+// The bounds of the status codes, open-ended ranges reach them.
+const (
+	minStatusCode = 100
+	maxStatusCode = 999
+)
+
+// codeAliases are the named sets of status codes.
+var codeAliases = map[string]string{
+	"client-errors":  "[400 499]",
+	"server-errors":  "[500 599]",
+	"gateway-errors": "[502 504]",
+	"throttled":      "429",
+	"timeouts":       "408 504",
+}
+
+// Codes is the set of status codes of a policy. Besides the notation of intervals it accepts the classes
+// of statuses like 5xx, the open-ended ranges like [500 ...) or >=500 and the aliases like gateway-errors.
+// A term prefixed with ! or - is excluded, eg: [500 599] !501 -[505 505].
+// String returns the terms as they were given in the canonical spelling, the excluded ones last with !.
+type Codes struct {
+	included []string
+	excluded []string
+	include  Interval
+	exclude  Interval
+}
+
+func ParseCodes(s string) (*Codes, error) {
+	terms, err := splitCodes(s)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.ParseCodes: %w", err)
+	}
+
+	c := &Codes{}
+
+	var include, exclude []string
+
+	for _, term := range terms {
+		excluded := term[0] == '!' || term[0] == '-'
+		if excluded {
+			term = term[1:]
+		}
+
+		canonical, iv, err := compileCode(term)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParseCodes: %w", err)
+		}
+
+		if excluded {
+			c.excluded = append(c.excluded, canonical)
+			exclude = append(exclude, iv)
+		} else {
+			c.included = append(c.included, canonical)
+			include = append(include, iv)
+		}
+	}
+
+	// the exclusions alone would match no code, which is a mistake rather than a policy
+	if len(include) == 0 && len(exclude) > 0 {
+		return nil, fmt.Errorf("traefikretryplugin.ParseCodes: `%s` only excludes codes", s)
+	}
+
+	if c.include, err = NewInterval(strings.Join(include, " ")); err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.ParseCodes: %w", err)
+	}
+
+	if len(exclude) > 0 {
+		if c.exclude, err = NewInterval(strings.Join(exclude, " ")); err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParseCodes: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *Codes) Includes(status int) bool {
+	return c.include.Includes(status) && (c.exclude == nil || !c.exclude.Includes(status))
+}
+
+func (c *Codes) String() string {
+	var sb strings.Builder
+
+	sb.WriteString(strings.Join(c.included, " "))
+
+	for _, term := range c.excluded {
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+
+		sb.WriteByte('!')
+		sb.WriteString(term)
+	}
+
+	return sb.String()
+}
+
+// splitCodes splits the codes by spaces keeping the bracketed ranges whole, along with their exclusion prefix.
+func splitCodes(s string) ([]string, error) {
+	var terms []string
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		end := strings.IndexAny(s, " \t")
+
+		if bracket := strings.IndexAny(s, "[("); bracket == 0 || bracket == 1 && (s[0] == '!' || s[0] == '-') {
+			end = strings.IndexAny(s, "])")
+			if end == -1 {
+				return nil, fmt.Errorf("traefikretryplugin.splitCodes: unclosed range `%s`", s)
+			}
+
+			end++
+		}
+
+		if end == -1 {
+			end = len(s)
+		}
+
+		terms = append(terms, s[:end])
+		s = s[end:]
+	}
+
+	return terms, nil
+}
+
+// compileCode translates the term into the notation of intervals, along with its canonical spelling.
+func compileCode(term string) (canonical, interval string, err error) {
+	if term == "" {
+		return "", "", fmt.Errorf("traefikretryplugin.compileCode: empty exclusion")
+	}
+
+	term = strings.ToLower(term)
+
+	if iv, ok := codeAliases[term]; ok {
+		return term, iv, nil
+	}
+
+	switch {
+	case term[0] == '[' || term[0] == '(':
+		return compileRange(term)
+	case strings.HasPrefix(term, ">=") || strings.HasPrefix(term, "<="):
+		return compileComparison(term, 2)
+	case term[0] == '>' || term[0] == '<':
+		return compileComparison(term, 1)
+	case len(term) == 3 && term[1:] == "xx" && term[0] >= '1' && term[0] <= '9':
+		return term, "[" + term[:1] + "00 " + term[:1] + "99]", nil
+	}
+
+	code, err := parseCode(term)
+	if err != nil {
+		return "", "", fmt.Errorf("traefikretryplugin.compileCode: %w", err)
+	}
+
+	return strconv.Itoa(code), strconv.Itoa(code), nil
+}
+
+// compileRange handles the bracketed range, either bound may be `...` for the open end.
+func compileRange(term string) (canonical, interval string, err error) {
+	fields := strings.Fields(term[1 : len(term)-1])
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("traefikretryplugin.compileRange: range `%s` needs two bounds", term)
+	}
+
+	from, to := fields[0], fields[1]
+	fromIv, toIv := from, to
+
+	if from == "..." {
+		fromIv = strconv.Itoa(minStatusCode)
+	} else if _, err = parseCode(from); err != nil {
+		return "", "", fmt.Errorf("traefikretryplugin.compileRange: %w", err)
+	}
+
+	if to == "..." {
+		toIv = strconv.Itoa(maxStatusCode)
+	} else if _, err = parseCode(to); err != nil {
+		return "", "", fmt.Errorf("traefikretryplugin.compileRange: %w", err)
+	}
+
+	open, closing := term[:1], term[len(term)-1:]
+
+	// an open end includes the bound of the status codes
+	if from == "..." {
+		open = "["
+	}
+
+	if to == "..." {
+		closing = "]"
+	}
+
+	return term[:1] + from + " " + to + term[len(term)-1:], open + fromIv + " " + toIv + closing, nil
+}
+
+func compileComparison(term string, n int) (canonical, interval string, err error) {
+	code, err := parseCode(term[n:])
+	if err != nil {
+		return "", "", fmt.Errorf("traefikretryplugin.compileComparison: %w", err)
+	}
+
+	op, c := term[:n], strconv.Itoa(code)
+
+	switch op {
+	case ">=":
+		interval = "[" + c + " " + strconv.Itoa(maxStatusCode) + "]"
+	case ">":
+		interval = "(" + c + " " + strconv.Itoa(maxStatusCode) + "]"
+	case "<=":
+		interval = "[" + strconv.Itoa(minStatusCode) + " " + c + "]"
+	case "<":
+		interval = "[" + strconv.Itoa(minStatusCode) + " " + c + ")"
+	}
+
+	return op + c, interval, nil
+}
+
+func parseCode(s string) (int, error) {
+	code, err := strconv.Atoi(s)
+	if err != nil || code < minStatusCode || code > maxStatusCode {
+		return 0, fmt.Errorf("traefikretryplugin.parseCode: invalid status code `%s`", s)
+	}
+
+	return code, nil
+}
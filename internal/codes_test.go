@@ -0,0 +1,93 @@
+package traefikretryplugin
+
+import (
+	"testing"
+)
+
+func TestParseCodes(t *testing.T) {
+	tests := []struct {
+		spec      string
+		canonical string
+		included  []int
+		excluded  []int
+	}{
+		{spec: "[500 599] ![400 510]", canonical: "[500 599] ![400 510]", included: []int{511, 599}, excluded: []int{404, 500, 510, 600}},
+		{spec: "-[501 501] 5xx", canonical: "5xx ![501 501]", included: []int{500, 502, 599}, excluded: []int{501, 499, 600}},
+		{spec: "[500 599] !501 !505", canonical: "[500 599] !501 !505", included: []int{500, 502, 504, 599}, excluded: []int{501, 505}},
+		{spec: "5xx !5xx", canonical: "5xx !5xx", excluded: []int{500, 503, 599}},
+		{spec: "gateway-errors throttled -503", canonical: "gateway-errors throttled !503", included: []int{429, 502, 504}, excluded: []int{500, 503}},
+		{spec: "5XX", canonical: "5xx", included: []int{500, 599}, excluded: []int{499, 600}},
+		{spec: "[500 ...)", canonical: "[500 ...)", included: []int{500, 999}, excluded: []int{499}},
+		{spec: "(... 200]", canonical: "(... 200]", included: []int{100, 200}, excluded: []int{201}},
+		{spec: ">=500", canonical: ">=500", included: []int{500, 999}, excluded: []int{499}},
+		{spec: ">500 !>=600", canonical: ">500 !>=600", included: []int{501, 599}, excluded: []int{500, 600}},
+		{spec: "<400", canonical: "<400", included: []int{100, 399}, excluded: []int{400}},
+		{spec: "<=400", canonical: "<=400", included: []int{400}, excluded: []int{401}},
+		{spec: "client-errors", canonical: "client-errors", included: []int{400, 499}, excluded: []int{500}},
+		{spec: "server-errors", canonical: "server-errors", included: []int{500, 599}, excluded: []int{499}},
+		{spec: "timeouts", canonical: "timeouts", included: []int{408, 504}, excluded: []int{500}},
+		{spec: "[502 504) 429", canonical: "[502 504) 429", included: []int{429, 502, 503}, excluded: []int{504}},
+		{spec: "", excluded: []int{200, 500}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			c, err := ParseCodes(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseCodes(%q): %v", tt.spec, err)
+			}
+
+			if c.String() != tt.canonical {
+				t.Errorf("String() = %q, want %q", c.String(), tt.canonical)
+			}
+
+			for _, code := range tt.included {
+				if !c.Includes(code) {
+					t.Errorf("Includes(%d) = false", code)
+				}
+			}
+
+			for _, code := range tt.excluded {
+				if c.Includes(code) {
+					t.Errorf("Includes(%d) = true", code)
+				}
+			}
+
+			// the canonical spelling parses back to the same codes
+			rt, err := ParseCodes(c.String())
+			if err != nil {
+				t.Fatalf("ParseCodes(%q): %v", c.String(), err)
+			}
+
+			if rt.String() != c.String() {
+				t.Errorf("round trip String() = %q, want %q", rt.String(), c.String())
+			}
+
+			for code := minStatusCode; code <= maxStatusCode; code++ {
+				if rt.Includes(code) != c.Includes(code) {
+					t.Errorf("round trip Includes(%d) = %v", code, rt.Includes(code))
+				}
+			}
+		})
+	}
+}
+
+func TestParseCodesErrors(t *testing.T) {
+	for _, spec := range []string{
+		"!501",
+		"-[501 501] ![505 505]",
+		"!",
+		"[500 599",
+		"[500]",
+		"6xx0",
+		"99",
+		"1000",
+		">=abc",
+		"[... 1000]",
+		"server-error",
+	} {
+		if _, err := ParseCodes(spec); err == nil {
+			t.Errorf("ParseCodes(%q) accepted", spec)
+		}
+	}
+}
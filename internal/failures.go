@@ -0,0 +1,126 @@
+package traefikretryplugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+)
+
+// Failures is a set of transport failure classes.
+type Failures int
+
+const (
+	FailureConnect Failures = 1 << iota
+	FailureReset
+	FailureTimeout
+
+	FailureNone Failures = 0
+)
+
+var failureNames = []struct {
+	f    Failures
+	name string
+}{
+	{FailureConnect, "connect-failure"},
+	{FailureReset, "reset"},
+	{FailureTimeout, "timeout"},
+}
+
+func ParseFailures(names []string) (Failures, error) {
+	var fs Failures
+
+L:
+	for _, name := range names {
+		for _, fn := range failureNames {
+			if strings.EqualFold(name, fn.name) {
+				fs |= fn.f
+				continue L
+			}
+		}
+
+		return FailureNone, fmt.Errorf("traefikretryplugin.ParseFailures: unknown failure `%s`", name)
+	}
+
+	return fs, nil
+}
+
+func (fs Failures) Includes(f Failures) bool {
+	return f != FailureNone && fs&f == f
+}
+
+func (fs Failures) String() string {
+	names := make([]string, 0, len(failureNames))
+
+	for _, fn := range failureNames {
+		if fs.Includes(fn.f) {
+			names = append(names, fn.name)
+		}
+	}
+
+	return strings.Join(names, " ")
+}
+
+// AttemptTrace follows the connection of the proxy to the upstream during an attempt.
+// Its hooks are called by the transport, possibly from other goroutines.
+type AttemptTrace struct {
+	mu          sync.Mutex
+	connectErr  bool
+	gotConn     bool
+	gotResponse bool
+}
+
+func NewAttemptTrace() *AttemptTrace {
+	return &AttemptTrace{}
+}
+
+// WithContext returns the context that reports the connection events to the trace.
+func (t *AttemptTrace) WithContext(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectDone: func(_, _ string, err error) {
+			if err != nil {
+				t.mu.Lock()
+				t.connectErr = true
+				t.mu.Unlock()
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.gotConn = true
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.gotResponse = true
+			t.mu.Unlock()
+		},
+	})
+}
+
+// Classify tells the failure behind the response. Traefik's proxy reports transport errors with
+// a bare 502 or 504 response, so a response of that shape the upstream never sent is a failure.
+// The proxy writes the status before any header, so a response with a header is taken as the
+// upstream's even when the trace missed its first byte.
+func (t *AttemptTrace) Classify(status int, header http.Header) Failures {
+	if t == nil || status != http.StatusBadGateway && status != http.StatusGatewayTimeout || len(header) > 0 {
+		return FailureNone
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.gotResponse:
+		return FailureNone
+	case t.connectErr:
+		return FailureConnect
+	case status == http.StatusGatewayTimeout:
+		return FailureTimeout
+	case !t.gotConn:
+		return FailureConnect
+	default:
+		return FailureReset
+	}
+}
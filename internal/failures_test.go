@@ -0,0 +1,124 @@
+package traefikretryplugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"testing"
+)
+
+// traceEvents reports the connection events to the trace like the transport does.
+func traceEvents(t *AttemptTrace, connectErr, gotConn, gotResponse bool) {
+	ct := httptrace.ContextClientTrace(t.WithContext(context.Background()))
+
+	if connectErr {
+		ct.ConnectDone("tcp", "127.0.0.1:80", errors.New("connection refused"))
+	}
+
+	if gotConn {
+		ct.GotConn(httptrace.GotConnInfo{})
+	}
+
+	if gotResponse {
+		ct.GotFirstResponseByte()
+	}
+}
+
+func TestParseFailures(t *testing.T) {
+	fs, err := ParseFailures([]string{"connect-failure", "TIMEOUT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fs.Includes(FailureConnect) || !fs.Includes(FailureTimeout) || fs.Includes(FailureReset) {
+		t.Errorf("ParseFailures() = %s, want connect-failure timeout", fs)
+	}
+
+	if _, err := ParseFailures([]string{"refused"}); err == nil {
+		t.Error("ParseFailures(refused) doesn't fail")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name        string
+		connectErr  bool
+		gotConn     bool
+		gotResponse bool
+		status      int
+		header      http.Header
+		want        Failures
+	}{
+		{name: "connect error", connectErr: true, status: http.StatusBadGateway, want: FailureConnect},
+		{name: "no connection", status: http.StatusBadGateway, want: FailureConnect},
+		{name: "connect timeout", connectErr: true, status: http.StatusGatewayTimeout, want: FailureConnect},
+		{name: "reset", gotConn: true, status: http.StatusBadGateway, want: FailureReset},
+		{name: "timeout", gotConn: true, status: http.StatusGatewayTimeout, want: FailureTimeout},
+		{name: "dial timeout", status: http.StatusGatewayTimeout, want: FailureTimeout},
+		{name: "upstream 502", gotConn: true, gotResponse: true, status: http.StatusBadGateway, want: FailureNone},
+		{name: "upstream 502 with header", gotConn: true, status: http.StatusBadGateway, header: http.Header{"Content-Type": {"text/plain"}}, want: FailureNone},
+		{name: "upstream 503", gotConn: true, status: http.StatusServiceUnavailable, want: FailureNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewAttemptTrace()
+			traceEvents(tr, tt.connectErr, tt.gotConn, tt.gotResponse)
+
+			if got := tr.Classify(tt.status, tt.header); got != tt.want {
+				t.Errorf("Classify(%d) = %q, want %q", tt.status, got, tt.want)
+			}
+		})
+	}
+
+	var tr *AttemptTrace
+
+	if got := tr.Classify(http.StatusBadGateway, nil); got != FailureNone {
+		t.Errorf("Classify() without trace = %q, want none", got)
+	}
+}
+
+func TestOn(t *testing.T) {
+	tests := []struct {
+		name     string
+		on       string
+		gotConn  bool
+		response bool
+		retry    bool
+		reason   string
+	}{
+		{name: "listed failure", on: "on=(connect-failure timeout)", retry: true, reason: "connect-failure"},
+		{name: "unlisted failure", on: "on=(connect-failure timeout)", gotConn: true, reason: "reset"},
+		{name: "single token", on: "on=reset", gotConn: true, retry: true, reason: "reset"},
+		{name: "upstream response", on: "on=connect-failure", gotConn: true, response: true, retry: true, reason: reasonStatus},
+		{name: "no on", gotConn: true, retry: true, reason: reasonStatus},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2})
+
+			if tt.on != "" {
+				var err error
+
+				if pl, err = parsePolicyHeader(t, tt.on, pl); err != nil {
+					t.Fatalf("ParsePolicy(%q): %v", tt.on, err)
+				}
+			}
+
+			tr := NewAttemptTrace()
+			traceEvents(tr, false, tt.gotConn, tt.response)
+
+			retry, reason := Attempt{Trace: tr}.classify(pl, http.StatusBadGateway, http.Header{})
+			if retry != tt.retry || reason != tt.reason {
+				t.Errorf("classify() = %v, %q, want %v, %q", retry, reason, tt.retry, tt.reason)
+			}
+		})
+	}
+
+	hp := "on=(refused)"
+	if _, err := parsePolicyHeader(t, hp, newTestPolicy(t, PolicyConfig{})); err == nil {
+		t.Errorf("ParsePolicy(%q) doesn't fail", hp)
+	}
+}
@@ -0,0 +1,183 @@
+package traefikretryplugin
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GRPCCodes is a set of gRPC status codes.
+type GRPCCodes uint32
+
+var grpcCodeNames = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// ParseGRPCCodes reads the codes either by their names, in any case and with hyphens
+// in place of underscores, or by their numbers.
+func ParseGRPCCodes(names []string) (GRPCCodes, error) {
+	var cs GRPCCodes
+
+L:
+	for _, name := range names {
+		if n, err := strconv.Atoi(name); err == nil && n >= 0 && n < len(grpcCodeNames) {
+			cs |= 1 << n
+			continue
+		}
+
+		for n, cn := range grpcCodeNames {
+			if strings.EqualFold(strings.ReplaceAll(name, "-", "_"), cn) {
+				cs |= 1 << n
+				continue L
+			}
+		}
+
+		return 0, fmt.Errorf("traefikretryplugin.ParseGRPCCodes: unknown code `%s`", name)
+	}
+
+	return cs, nil
+}
+
+func (cs GRPCCodes) Includes(code int) bool {
+	return code >= 0 && code < len(grpcCodeNames) && cs&(1<<code) != 0
+}
+
+func (cs GRPCCodes) String() string {
+	names := make([]string, 0, len(grpcCodeNames))
+
+	for n, name := range grpcCodeNames {
+		if cs.Includes(n) {
+			names = append(names, name)
+		}
+	}
+
+	return strings.Join(names, " ")
+}
+
+// grpcValue reads the gRPC field from the trailers, either declared or prefixed, or from the header
+// of a trailers-only response.
+func grpcValue(header, trailer http.Header, key string) (string, bool) {
+	for _, h := range []http.Header{trailer, header} {
+		if v, ok := h[http.CanonicalHeaderKey(key)]; ok && len(v) > 0 {
+			return v[0], true
+		}
+
+		if v, ok := h[http.TrailerPrefix+http.CanonicalHeaderKey(key)]; ok && len(v) > 0 {
+			return v[0], true
+		}
+	}
+
+	return "", false
+}
+
+// grpcStatus is the status of the gRPC response, false until the status is sent.
+func grpcStatus(header, trailer http.Header) (int, bool) {
+	v, ok := grpcValue(header, trailer, "Grpc-Status")
+	if !ok {
+		return 0, false
+	}
+
+	code, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return 0, false
+	}
+
+	return code, true
+}
+
+// grpcPushback reads the delay the server asks for. A negative or malformed delay means the server
+// asks not to retry, ok is false when there is no pushback at all.
+func grpcPushback(header, trailer http.Header) (d time.Duration, retry, ok bool) {
+	v, ok := grpcValue(header, trailer, "Grpc-Retry-Pushback-Ms")
+	if !ok {
+		return 0, false, false
+	}
+
+	ms, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || ms < 0 {
+		return 0, false, true
+	}
+
+	return time.Duration(ms) * time.Millisecond, true, true
+}
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// ParseGRPCTimeout reads the grpc-timeout request header: at most 8 digits followed by the unit, eg: 100m.
+func ParseGRPCTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, fmt.Errorf("traefikretryplugin.ParseGRPCTimeout: invalid timeout `%s`", v)
+	}
+
+	unit, ok := grpcTimeoutUnits[v[len(v)-1]]
+	if !ok {
+		return 0, fmt.Errorf("traefikretryplugin.ParseGRPCTimeout: unknown unit of `%s`", v)
+	}
+
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("traefikretryplugin.ParseGRPCTimeout: invalid timeout `%s`", v)
+	}
+
+	// 8 digits of hours overflow the duration, such a timeout is no timeout in practice
+	if n > math.MaxInt64/int64(unit) {
+		return math.MaxInt64, nil
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// FormatGRPCTimeout formats the timeout in milliseconds, or in the smallest coarser unit fitting 8 digits.
+func FormatGRPCTimeout(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+
+	if ms := d.Milliseconds(); ms < 1e8 {
+		return strconv.FormatInt(ms, 10) + "m"
+	}
+
+	if s := int64(d / time.Second); s < 1e8 {
+		return strconv.FormatInt(s, 10) + "S"
+	}
+
+	if m := int64(d / time.Minute); m < 1e8 {
+		return strconv.FormatInt(m, 10) + "M"
+	}
+
+	return strconv.FormatInt(int64(d/time.Hour), 10) + "H"
+}
+
+// IsGRPC tells whether the request is a gRPC call, gRPC-Web sending the trailers in the body isn't.
+func IsGRPC(req *http.Request) bool {
+	ct := req.Header.Get("Content-Type")
+
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") ||
+		strings.HasPrefix(ct, "application/grpc;")
+}
@@ -0,0 +1,65 @@
+package traefikretryplugin
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		v    string
+		want time.Duration
+	}{
+		{v: "100m", want: 100 * time.Millisecond},
+		{v: "1S", want: time.Second},
+		{v: "2M", want: 2 * time.Minute},
+		{v: "3H", want: 3 * time.Hour},
+		{v: "5u", want: 5 * time.Microsecond},
+		{v: "99999999n", want: 99999999 * time.Nanosecond},
+		{v: "0m"},
+		{v: "2562047H", want: 2562047 * time.Hour},
+		// the timeouts overflowing the duration are clamped
+		{v: "2562048H", want: math.MaxInt64},
+		{v: "99999999H", want: math.MaxInt64},
+		{v: "99999999M", want: 99999999 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseGRPCTimeout(tt.v)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseGRPCTimeout(%s) = %s, %v, want %s", tt.v, got, err, tt.want)
+		}
+	}
+
+	for _, v := range []string{"", "m", "100", "100x", "123456789S", "-1S", "1.5S"} {
+		if _, err := ParseGRPCTimeout(v); err == nil {
+			t.Errorf("ParseGRPCTimeout(%q) doesn't fail", v)
+		}
+	}
+}
+
+func TestFormatGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: -time.Second, want: "0m"},
+		{d: 1500 * time.Microsecond, want: "1m"},
+		{d: 99999999 * time.Millisecond, want: "99999999m"},
+		{d: 1e8 * time.Millisecond, want: "100000S"},
+		{d: 1e8 * time.Second, want: "1666666M"},
+		{d: math.MaxInt64, want: "2562047H"},
+	}
+
+	for _, tt := range tests {
+		got := FormatGRPCTimeout(tt.d)
+		if got != tt.want {
+			t.Errorf("FormatGRPCTimeout(%s) = %s, want %s", tt.d, got, tt.want)
+		}
+
+		if d, err := ParseGRPCTimeout(got); err != nil || tt.d > 0 && d > tt.d {
+			t.Errorf("ParseGRPCTimeout(%s) = %s, %v, want at most %s", got, d, err, tt.d)
+		}
+	}
+}
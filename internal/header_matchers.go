@@ -0,0 +1,74 @@
+package traefikretryplugin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type headerMatcher struct {
+	name  string
+	value string
+}
+
+// HeaderMatchers match the response headers that make an attempt retryable, whatever its status.
+// A matcher is either `Name: value`, matching a field of the header equal to the value, or `Name`
+// matching the header present with any value.
+type HeaderMatchers []headerMatcher
+
+func ParseHeaderMatchers(specs []string) (HeaderMatchers, error) {
+	hm := make(HeaderMatchers, 0, len(specs))
+
+	for _, spec := range specs {
+		name, value, _ := strings.Cut(spec, ":")
+
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("traefikretryplugin.ParseHeaderMatchers: invalid header name in `%s`", spec)
+		}
+
+		hm = append(hm, headerMatcher{
+			name:  http.CanonicalHeaderKey(name),
+			value: strings.TrimSpace(value),
+		})
+	}
+
+	return hm, nil
+}
+
+func (hm HeaderMatchers) Match(h http.Header) bool {
+	for _, m := range hm {
+		for _, v := range h.Values(m.name) {
+			if m.value == "" || strings.TrimSpace(v) == m.value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// String formats the matchers as the inner list of the policy header.
+func (hm HeaderMatchers) String() string {
+	var sb strings.Builder
+
+	sb.WriteByte('(')
+
+	for i, m := range hm {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+
+		s := m.name
+		if m.value != "" {
+			s += ": " + m.value
+		}
+
+		sb.WriteString(strconv.Quote(s))
+	}
+
+	sb.WriteByte(')')
+
+	return sb.String()
+}
@@ -0,0 +1,88 @@
+package traefikretryplugin
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseHeaderMatchers(t *testing.T) {
+	hm, err := ParseHeaderMatchers([]string{"x-retryable: ?1", " Grpc-Status :14 ", "X-Overloaded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := hm.String(); s != `("X-Retryable: ?1" "Grpc-Status: 14" "X-Overloaded")` {
+		t.Errorf("ParseHeaderMatchers() = %s", s)
+	}
+
+	for _, spec := range []string{"", ": 1", "X Retryable: 1", "X\tRetryable: 1"} {
+		if _, err := ParseHeaderMatchers([]string{spec}); err == nil {
+			t.Errorf("ParseHeaderMatchers(%q) doesn't fail", spec)
+		}
+	}
+}
+
+func TestHeaderMatchersMatch(t *testing.T) {
+	hm, err := ParseHeaderMatchers([]string{"X-Retryable: ?1", "X-Overloaded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		match  bool
+	}{
+		{name: "value", header: http.Header{"X-Retryable": {"?1"}}, match: true},
+		{name: "spaced value", header: http.Header{"X-Retryable": {" ?1 "}}, match: true},
+		{name: "one of the values", header: http.Header{"X-Retryable": {"?0", "?1"}}, match: true},
+		{name: "other value", header: http.Header{"X-Retryable": {"?0"}}},
+		{name: "bare name", header: http.Header{"X-Overloaded": {"anything"}}, match: true},
+		{name: "bare name without value", header: http.Header{"X-Overloaded": {""}}, match: true},
+		{name: "absent", header: http.Header{"X-Other": {"?1"}}},
+		{name: "empty", header: http.Header{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hm.Match(tt.header); got != tt.match {
+				t.Errorf("Match(%v) = %v, want %v", tt.header, got, tt.match)
+			}
+		})
+	}
+}
+
+func TestPolicyHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		header http.Header
+		match  bool
+	}{
+		{name: "inner list", policy: `headers=("X-Retryable: ?1" "Grpc-Status: 14")`, header: http.Header{"Grpc-Status": {"14"}}, match: true},
+		{name: "single string", policy: `headers="X-Retryable"`, header: http.Header{"X-Retryable": {"yes"}}, match: true},
+		{name: "other value", policy: `headers=("X-Retryable: ?1")`, header: http.Header{"X-Retryable": {"?0"}}},
+		{name: "overrides the configuration", policy: `headers=("X-Retryable: ?1")`, header: http.Header{"X-Configured": {"1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2, Headers: []string{"X-Configured"}})
+
+			pl, err := parsePolicyHeader(t, tt.policy, base)
+			if err != nil {
+				t.Fatalf("ParsePolicy(%q): %v", tt.policy, err)
+			}
+
+			if got := pl.MatchesHeaders(tt.header); got != tt.match {
+				t.Errorf("MatchesHeaders(%v) = %v, want %v", tt.header, got, tt.match)
+			}
+		})
+	}
+
+	for _, policy := range []string{`headers=(": 1")`, `headers=(X-Retryable)`, `headers=1`} {
+		if _, err := parsePolicyHeader(t, policy, nil); err == nil {
+			t.Errorf("ParsePolicy(%q) doesn't fail", policy)
+		}
+	}
+}
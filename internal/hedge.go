@@ -0,0 +1,455 @@
+package traefikretryplugin
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type hedgeAttempt struct {
+	cancel context.CancelFunc
+	// cancelled tells whether the attempt was cancelled, by the hedge or the client, rather than timed out
+	cancelled func() bool
+	decided   bool
+	failed    bool
+	reason    string
+	finished  bool
+}
+
+// Hedge runs attempts of a request in parallel: a new attempt starts whenever no acceptable
+// response arrived within the hedge delay, or right after an attempt failed. The first acceptable
+// response is committed to the client and the other attempts are cancelled.
+type Hedge struct {
+	mu        sync.Mutex
+	rw        http.ResponseWriter
+	policy    *RetryPolicy
+	base      Attempt
+	attempts  []*hedgeAttempt
+	winner    int
+	failures  int
+	discarded []int
+	events    chan struct{}
+}
+
+// NewHedge creates the hedge of a request, the base attempt holds the deadline and the limits of the retries.
+func NewHedge(rw http.ResponseWriter, policy *RetryPolicy, base Attempt) *Hedge {
+	return &Hedge{
+		rw:     rw,
+		policy: policy,
+		base:   base,
+		winner: -1,
+		events: make(chan struct{}, 1),
+	}
+}
+
+// Run starts the attempts and returns once the committed one is served.
+func (h *Hedge) Run(ctx context.Context, serve func(ctx context.Context, w *HedgeResponseWriter)) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// without the delay the attempts start all at once and are replaced only when they fail
+	var hedges <-chan time.Time
+
+	if d := h.policy.hedgeDelay; d > 0 {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+
+		hedges = ticker.C
+
+		h.start(ctx, &wg, serve)
+	} else {
+		for h.canHedge() {
+			if !h.start(ctx, &wg, serve) {
+				break
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.events:
+		case <-hedges:
+			if h.canHedge() {
+				h.start(ctx, &wg, serve)
+			}
+		}
+
+		for h.takeFailure() {
+			if !h.start(ctx, &wg, serve) {
+				break
+			}
+		}
+
+		if h.done() {
+			return
+		}
+	}
+}
+
+// start starts an attempt unless it's a hedge the budget can't afford anymore.
+func (h *Hedge) start(ctx context.Context, wg *sync.WaitGroup, serve func(ctx context.Context, w *HedgeResponseWriter)) bool {
+	// the budget is shared with the other requests, the retry checked by canStart may be spent already
+	if h.Attempts() > 0 && !h.base.Budget.Withdraw() {
+		return false
+	}
+
+	var cancel context.CancelFunc
+
+	a := h.base
+
+	// the attempts are classified like the sequential ones, the cancellation of the losers isn't a timeout
+	if t := h.policy.perTryTimeout; t > 0 {
+		parent := ctx
+
+		tctx, tcancel := context.WithTimeout(parent, t)
+		a.TimedOut = func() bool {
+			return tctx.Err() == context.DeadlineExceeded && parent.Err() == nil
+		}
+
+		ctx, cancel = tctx, tcancel
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	if h.policy.HandlesFailures() {
+		a.Trace = NewAttemptTrace()
+		ctx = a.Trace.WithContext(ctx)
+	}
+
+	h.mu.Lock()
+	a.Number = len(h.attempts)
+	h.attempts = append(h.attempts, &hedgeAttempt{
+		cancel: cancel,
+		cancelled: func() bool {
+			return ctx.Err() == context.Canceled
+		},
+	})
+	h.mu.Unlock()
+
+	w := &HedgeResponseWriter{
+		hedge:   h,
+		attempt: a,
+		header:  make(http.Header),
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		defer cancel()
+
+		serve(ctx, w)
+
+		w.finish()
+	}()
+
+	return true
+}
+
+func (h *Hedge) notify() {
+	select {
+	case h.events <- struct{}{}:
+	default:
+	}
+}
+
+// canStart tells whether one more attempt is allowed, the lock must be held.
+func (h *Hedge) canStart() bool {
+	return h.winner == -1 && len(h.attempts) <= h.policy.attempts &&
+		h.base.startsBefore(0) &&
+		(len(h.attempts) == 0 || h.base.Breaker.AllowsRetries() && h.base.Budget.Available())
+}
+
+// undecided counts the attempts still waiting for the response, the lock must be held.
+func (h *Hedge) undecided() int {
+	n := 0
+
+	for _, a := range h.attempts {
+		if !a.decided {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (h *Hedge) canHedge() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.canStart() && h.undecided() < h.policy.parallel
+}
+
+// takeFailure consumes a failed attempt to be replaced by a new one.
+func (h *Hedge) takeFailure() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.failures == 0 || !h.canStart() || h.undecided() >= h.policy.parallel {
+		return false
+	}
+
+	h.failures--
+
+	return true
+}
+
+func (h *Hedge) done() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.winner != -1 {
+		return h.attempts[h.winner].finished
+	}
+
+	for _, a := range h.attempts {
+		if !a.finished {
+			return false
+		}
+	}
+
+	// every attempt was discarded expecting another one that is not allowed to start anymore
+	if h.base.Info != nil {
+		h.rw.Header().Set("Retry-Info", h.info())
+	}
+
+	http.Error(h.rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+
+	return true
+}
+
+// decide tells whether the response of the attempt is committed to the client.
+func (h *Hedge) decide(a Attempt, status int, header http.Header) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := a.Number
+	h.attempts[n].decided = true
+
+	failed, reason := a.classify(h.policy, status, header)
+	h.attempts[n].failed = failed
+	h.attempts[n].reason = reason
+
+	// the losers and the attempts given up by the client tell nothing of the upstream
+	if h.winner != -1 {
+		return false
+	}
+
+	if h.attempts[n].cancelled() {
+		return false
+	}
+
+	h.base.Breaker.Record(failed)
+
+	if failed && (h.undecided() > 0 || h.canStart()) {
+		h.failures++
+		h.discarded = append(h.discarded, status)
+		h.notify()
+
+		return false
+	}
+
+	h.winner = n
+
+	for i, other := range h.attempts {
+		if i != n {
+			other.cancel()
+		}
+	}
+
+	return true
+}
+
+// Attempts counts the attempts started so far.
+func (h *Hedge) Attempts() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.attempts)
+}
+
+// Discarded lists the statuses of the failed attempts that were not committed.
+func (h *Hedge) Discarded() []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]int(nil), h.discarded...)
+}
+
+// Failed tells whether the committed response is a failure, or no response was committed at all.
+func (h *Hedge) Failed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.winner == -1 || h.attempts[h.winner].failed
+}
+
+// info formats the Retry-Info header of the committed response, the lock must be held.
+func (h *Hedge) info() string {
+	ri := RetryInfo{Discarded: h.discarded}
+
+	if h.winner != -1 && !h.attempts[h.winner].failed {
+		return ri.Header(len(h.attempts), stoppedBySuccess)
+	}
+
+	return ri.Header(len(h.attempts), h.stopReason())
+}
+
+// stopReason tells why no more attempts are started, the lock must be held.
+func (h *Hedge) stopReason() string {
+	switch {
+	case len(h.attempts) > h.policy.attempts:
+		return stoppedByExhaustion
+	case !h.base.startsBefore(0):
+		return stoppedByDeadline
+	case !h.base.Breaker.AllowsRetries():
+		return stoppedByBreaker
+	case !h.base.Budget.Available():
+		return stoppedByBudget
+	default:
+		return stoppedByExhaustion
+	}
+}
+
+func (h *Hedge) finish(n int) {
+	h.mu.Lock()
+	h.attempts[n].finished = true
+	h.mu.Unlock()
+
+	h.notify()
+}
+
+// HedgeResponseWriter holds the header of an attempt until its response is either committed or discarded.
+type HedgeResponseWriter struct {
+	hedge     *Hedge
+	attempt   Attempt
+	header    http.Header
+	status    int
+	decided   bool
+	committed bool
+}
+
+// Attempt is the number of the attempt, zero for the first one.
+func (w *HedgeResponseWriter) Attempt() int {
+	return w.attempt.Number
+}
+
+// Status is the status of the attempt, zero until the handler writes it.
+func (w *HedgeResponseWriter) Status() int {
+	return w.status
+}
+
+// Committed tells whether the response of the attempt is sent to the client.
+func (w *HedgeResponseWriter) Committed() bool {
+	return w.committed
+}
+
+// Failed tells whether the attempt is a failure according to the policy.
+func (w *HedgeResponseWriter) Failed() bool {
+	w.hedge.mu.Lock()
+	defer w.hedge.mu.Unlock()
+
+	return w.hedge.attempts[w.attempt.Number].failed
+}
+
+// Reason tells why the attempt failed, it's empty unless the attempt failed.
+func (w *HedgeResponseWriter) Reason() string {
+	w.hedge.mu.Lock()
+	defer w.hedge.mu.Unlock()
+
+	if a := w.hedge.attempts[w.attempt.Number]; a.failed {
+		return a.reason
+	}
+
+	return ""
+}
+
+func (w *HedgeResponseWriter) Header() http.Header {
+	if w.committed {
+		return w.hedge.rw.Header()
+	}
+
+	return w.header
+}
+
+func (w *HedgeResponseWriter) WriteHeader(status int) {
+	if w.decided || isInformational(status) {
+		return
+	}
+
+	w.decided = true
+	w.status = status
+	w.committed = w.hedge.decide(w.attempt, status, w.header)
+
+	if !w.committed {
+		return
+	}
+
+	h := w.hedge.rw.Header()
+
+	for k, v := range w.header {
+		h[k] = v
+	}
+
+	if w.attempt.Number > 0 {
+		h.Add("Retry-Attempt", strconv.Itoa(w.attempt.Number))
+	}
+
+	if w.hedge.base.Info != nil {
+		w.hedge.mu.Lock()
+		h.Set("Retry-Info", w.hedge.info())
+		w.hedge.mu.Unlock()
+	}
+
+	w.hedge.rw.WriteHeader(status)
+}
+
+func (w *HedgeResponseWriter) Write(body []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.committed {
+		return len(body), nil
+	}
+
+	return w.hedge.rw.Write(body)
+}
+
+func (w *HedgeResponseWriter) Flush() {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.committed {
+		return
+	}
+
+	if f, ok := w.hedge.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is not supported since several attempts may run at once.
+func (w *HedgeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, fmt.Errorf("traefikretryplugin.Hijack: hedged attempt: %w", http.ErrNotSupported)
+}
+
+// finish commits the implicit 200 of a handler that returned without writing.
+func (w *HedgeResponseWriter) finish() {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	w.hedge.finish(w.attempt.Number)
+}
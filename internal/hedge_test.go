@@ -0,0 +1,220 @@
+package traefikretryplugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHedgePerTryTimeout(t *testing.T) {
+	pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2, Mode: "hedge", Parallel: 1, PerTryTimeout: "20ms"})
+	rec := httptest.NewRecorder()
+	h := NewHedge(rec, pl, Attempt{})
+
+	h.Run(context.Background(), func(ctx context.Context, w *HedgeResponseWriter) {
+		if w.Attempt() == 0 {
+			// like the proxy does when the request is cancelled
+			<-ctx.Done()
+			w.WriteHeader(499)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	if rec.Code != http.StatusOK || h.Attempts() != 2 {
+		t.Errorf("status %d after %d attempts, want 200 after 2", rec.Code, h.Attempts())
+	}
+}
+
+func TestHedgeReason(t *testing.T) {
+	pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 1, Mode: "hedge", Parallel: 1, Headers: []string{"X-Retryable"}})
+	h := NewHedge(httptest.NewRecorder(), pl, Attempt{})
+
+	reasons := make([]string, 2)
+
+	h.Run(context.Background(), func(ctx context.Context, w *HedgeResponseWriter) {
+		if w.Attempt() == 0 {
+			w.Header().Set("X-Retryable", "1")
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		reasons[w.Attempt()] = w.Reason()
+	})
+
+	if reasons[0] != reasonHeader || reasons[1] != "" {
+		t.Errorf("reasons %q, want the header for the first attempt only", reasons)
+	}
+}
+
+func TestHedgeRejectsGRPC(t *testing.T) {
+	if _, err := NewPolicy(PolicyConfig{Mode: "hedge", GRPCCodes: []string{"unavailable"}}); !errors.Is(err, errHedgedGRPC) {
+		t.Errorf("NewPolicy() = %v, want %v", err, errHedgedGRPC)
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	const delay = 30 * time.Millisecond
+
+	pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 1, Mode: "hedge", Parallel: 2, HedgeDelay: "30ms"})
+	rec := httptest.NewRecorder()
+	h := NewHedge(rec, pl, Attempt{})
+
+	var mu sync.Mutex
+
+	starts := make([]time.Time, 2)
+
+	h.Run(context.Background(), func(ctx context.Context, w *HedgeResponseWriter) {
+		mu.Lock()
+		starts[w.Attempt()] = time.Now()
+		mu.Unlock()
+
+		if w.Attempt() == 0 {
+			<-ctx.Done()
+			w.WriteHeader(499)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	if h.Attempts() != 2 || rec.Code != http.StatusOK {
+		t.Fatalf("status %d after %d attempts, want 200 after 2", rec.Code, h.Attempts())
+	}
+
+	if d := starts[1].Sub(starts[0]); d < delay {
+		t.Errorf("the hedge started %s after the first attempt, want after %s", d, delay)
+	}
+}
+
+func TestHedgeFirstAcceptable(t *testing.T) {
+	pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2, Mode: "hedge", Parallel: 3})
+	rec := httptest.NewRecorder()
+	h := NewHedge(rec, pl, Attempt{})
+
+	cancelled := make(chan bool, 1)
+
+	h.Run(context.Background(), func(ctx context.Context, w *HedgeResponseWriter) {
+		switch w.Attempt() {
+		case 0:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 1:
+			time.Sleep(10 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("1"))
+		default:
+			select {
+			case <-ctx.Done():
+				cancelled <- true
+			case <-time.After(time.Second):
+				cancelled <- false
+			}
+
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("2"))
+		}
+	})
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "1" {
+		t.Errorf("status %d, body %q, want the first acceptable response", rec.Code, rec.Body.String())
+	}
+
+	if !<-cancelled {
+		t.Error("the loser isn't cancelled")
+	}
+
+	if d := h.Discarded(); len(d) != 1 || d[0] != http.StatusServiceUnavailable {
+		t.Errorf("discarded %v, want the 503", d)
+	}
+}
+
+func TestHedgeParallel(t *testing.T) {
+	pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 4, Mode: "hedge", Parallel: 2, HedgeDelay: "1ms"})
+	h := NewHedge(httptest.NewRecorder(), pl, Attempt{})
+
+	var mu sync.Mutex
+
+	running, most := 0, 0
+
+	h.Run(context.Background(), func(ctx context.Context, w *HedgeResponseWriter) {
+		mu.Lock()
+		running++
+
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		// the attempt stops running before its response lets another one start
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	if h.Attempts() != 5 || most != 2 {
+		t.Errorf("%d attempts, %d at once, want 5, 2 at once", h.Attempts(), most)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 3, Mode: "hedge", Parallel: 4})
+
+	// the floor allows a single retry within the one second window
+	h := NewHedge(httptest.NewRecorder(), pl, Attempt{Budget: NewRetryBudget(0, 1, time.Second)})
+
+	h.Run(context.Background(), func(ctx context.Context, w *HedgeResponseWriter) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	if h.Attempts() != 2 {
+		t.Errorf("%d attempts, want the budget to allow a single hedge", h.Attempts())
+	}
+}
+
+func TestHedgeBreaker(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    PolicyConfig
+		winner    int
+		successes int
+		failures  int
+	}{
+		{name: "cancelled losers", config: PolicyConfig{Codes: "5xx", Attempts: 2, Mode: "hedge", Parallel: 3}, successes: 1},
+		{name: "timed out", config: PolicyConfig{Codes: "5xx", Attempts: 1, Mode: "hedge", Parallel: 1, PerTryTimeout: "20ms"}, winner: 1, successes: 1, failures: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewCircuitBreaker(BreakerConfig{FailureRatio: 1, MinAttempts: 100, Window: time.Minute})
+			h := NewHedge(httptest.NewRecorder(), newTestPolicy(t, tt.config), Attempt{Breaker: b})
+
+			h.Run(context.Background(), func(ctx context.Context, w *HedgeResponseWriter) {
+				if w.Attempt() == tt.winner {
+					// the other attempts are started meanwhile
+					time.Sleep(10 * time.Millisecond)
+					w.WriteHeader(http.StatusOK)
+
+					return
+				}
+
+				<-ctx.Done()
+				w.WriteHeader(499)
+			})
+
+			if successes, failures := b.window.sums(time.Now()); successes != tt.successes || failures != tt.failures {
+				t.Errorf("recorded %d successes, %d failures, want %d, %d", successes, failures, tt.successes, tt.failures)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package traefikretryplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("traefikretryplugin.ParseLevel: unknown level `%s`", s)
+}
+
+type LogFormat int
+
+const (
+	LogFormatLogfmt LogFormat = iota
+	LogFormatJSON
+)
+
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "logfmt":
+		return LogFormatLogfmt, nil
+	case "json":
+		return LogFormatJSON, nil
+	default:
+		return LogFormatLogfmt, fmt.Errorf("traefikretryplugin.ParseLogFormat: unknown format `%s`", s)
+	}
+}
+
+type logOutput struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// Logger writes leveled records, one per line, with the fields given as key-value pairs.
+// A nil logger discards everything.
+type Logger struct {
+	output *logOutput
+	level  Level
+	format LogFormat
+	fields []interface{}
+}
+
+func NewLogger(out io.Writer, level Level, format LogFormat) *Logger {
+	return &Logger{
+		output: &logOutput{out: out},
+		level:  level,
+		format: format,
+	}
+}
+
+// With returns the logger adding the fields to every record.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	return &Logger{
+		output: l.output,
+		level:  l.level,
+		format: l.format,
+		fields: fields,
+	}
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	record := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	record = append(record, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	record = append(record, l.fields...)
+	record = append(record, kv...)
+
+	var sb strings.Builder
+
+	if l.format == LogFormatJSON {
+		writeJSON(&sb, record)
+	} else {
+		writeLogfmt(&sb, record)
+	}
+
+	sb.WriteByte('\n')
+
+	l.output.mu.Lock()
+	defer l.output.mu.Unlock()
+
+	_, _ = io.WriteString(l.output.out, sb.String())
+}
+
+func writeLogfmt(sb *strings.Builder, record []interface{}) {
+	for i := 0; i < len(record); i += 2 {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+
+		sb.WriteString(fieldKey(record, i))
+		sb.WriteByte('=')
+
+		v := fieldValue(record, i)
+		if v == "" || strings.ContainsAny(v, " =\"\\\n\t") {
+			v = strconv.Quote(v)
+		}
+
+		sb.WriteString(v)
+	}
+}
+
+func writeJSON(sb *strings.Builder, record []interface{}) {
+	sb.WriteByte('{')
+
+	for i := 0; i < len(record); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+
+		k, _ := json.Marshal(fieldKey(record, i))
+		sb.Write(k)
+		sb.WriteByte(':')
+
+		var value interface{}
+		if i+1 < len(record) {
+			value = record[i+1]
+		}
+
+		var v []byte
+
+		switch value.(type) {
+		case int, int64, float64, bool:
+			v, _ = json.Marshal(value)
+		default:
+			v, _ = json.Marshal(fieldValue(record, i))
+		}
+
+		sb.Write(v)
+	}
+
+	sb.WriteByte('}')
+}
+
+func fieldKey(record []interface{}, i int) string {
+	if k, ok := record[i].(string); ok {
+		return k
+	}
+
+	return fmt.Sprint(record[i])
+}
+
+func fieldValue(record []interface{}, i int) string {
+	if i+1 >= len(record) {
+		return ""
+	}
+
+	switch v := record[i+1].(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,57 @@
+package traefikretryplugin
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// idempotentMethods are the idempotent methods of RFC 9110, section 9.2.2.
+var idempotentMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+type methods map[string]struct{}
+
+func newMethods(names []string) methods {
+	m := make(methods, len(names))
+
+	for _, name := range names {
+		m[strings.ToUpper(strings.TrimSpace(name))] = struct{}{}
+	}
+
+	return m
+}
+
+func (m methods) includes(method string) bool {
+	_, ok := m[method]
+
+	return ok
+}
+
+func (m methods) String() string {
+	names := make([]string, 0, len(m))
+
+	for name := range m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, " ")
+}
+
+func isIdempotent(method string) bool {
+	for _, m := range idempotentMethods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
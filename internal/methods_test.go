@@ -0,0 +1,49 @@
+package traefikretryplugin
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAllowsMethod(t *testing.T) {
+	tests := []struct {
+		name           string
+		methods        []string
+		header         string
+		method         string
+		idempotencyKey bool
+		allowed        bool
+	}{
+		{name: "default GET", method: http.MethodGet, allowed: true},
+		{name: "default PUT", method: http.MethodPut, allowed: true},
+		{name: "default DELETE", method: http.MethodDelete, allowed: true},
+		{name: "default POST", method: http.MethodPost},
+		{name: "default PATCH", method: http.MethodPatch},
+		{name: "idempotency key POST", method: http.MethodPost, idempotencyKey: true, allowed: true},
+		{name: "idempotency key PATCH", method: http.MethodPatch, idempotencyKey: true, allowed: true},
+		{name: "explicit POST", methods: []string{"post"}, method: http.MethodPost, allowed: true},
+		{name: "explicit list excludes GET", methods: []string{http.MethodPost}, method: http.MethodGet},
+		{name: "explicit list excludes GET with key", methods: []string{http.MethodPost}, method: http.MethodGet, idempotencyKey: true},
+		{name: "header POST", header: "methods=POST", method: http.MethodPost, allowed: true},
+		{name: "header list", header: "methods=(GET POST)", method: http.MethodPost, allowed: true},
+		{name: "header list excludes PUT", header: "methods=(GET POST)", method: http.MethodPut},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2, Methods: tt.methods})
+
+			if tt.header != "" {
+				var err error
+
+				if pl, err = parsePolicyHeader(t, tt.header, pl); err != nil {
+					t.Fatalf("ParsePolicy(%q): %v", tt.header, err)
+				}
+			}
+
+			if got := pl.AllowsMethod(tt.method, tt.idempotencyKey); got != tt.allowed {
+				t.Errorf("AllowsMethod(%s, %v) = %v, want %v", tt.method, tt.idempotencyKey, got, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package traefikretryplugin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type counter struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (c *counter) add(v float64) {
+	c.mu.Lock()
+	c.v += v
+	c.mu.Unlock()
+}
+
+func (c *counter) value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.v
+}
+
+type codeCounter struct {
+	mu sync.Mutex
+	v  map[int]float64
+}
+
+func (c *codeCounter) inc(code int) {
+	c.mu.Lock()
+	c.v[code]++
+	c.mu.Unlock()
+}
+
+func (c *codeCounter) values() ([]int, map[int]float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	codes := make([]int, 0, len(c.v))
+	values := make(map[int]float64, len(c.v))
+
+	for code, v := range c.v {
+		codes = append(codes, code)
+		values[code] = v
+	}
+
+	sort.Ints(codes)
+
+	return codes, values
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []float64
+	sum     float64
+	count   float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{
+		bounds:  bounds,
+		buckets: make([]float64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.bounds {
+		if v <= b {
+			h.buckets[i]++
+		}
+	}
+
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) snapshot() (buckets []float64, sum, count float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]float64(nil), h.buckets...), h.sum, h.count
+}
+
+// Metrics are the retry metrics of a plugin instance. Nil metrics record nothing.
+type Metrics struct {
+	name      string
+	requests  counter
+	exhausted counter
+	retries   codeCounter
+	attempts  *histogram
+	bodyBytes *histogram
+	backoff   *histogram
+}
+
+func NewMetrics(name string) *Metrics {
+	return &Metrics{
+		name:      name,
+		retries:   codeCounter{v: make(map[int]float64)},
+		attempts:  newHistogram(1, 2, 3, 4, 5, 7, 10),
+		bodyBytes: newHistogram(0, 1<<10, 16<<10, 64<<10, 256<<10, 1<<20, 4<<20, 16<<20, 64<<20),
+		backoff:   newHistogram(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30),
+	}
+}
+
+// Request records a request handled with a retry policy and the size of its buffered body.
+func (m *Metrics) Request(bodyBytes int64) {
+	if m == nil {
+		return
+	}
+
+	m.requests.add(1)
+	m.bodyBytes.observe(float64(bodyBytes))
+}
+
+// Retry records an attempt discarded to be retried.
+func (m *Metrics) Retry(status int) {
+	if m == nil {
+		return
+	}
+
+	m.retries.inc(status)
+}
+
+// Wait records the backoff before a retried attempt.
+func (m *Metrics) Wait(delay time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.backoff.observe(delay.Seconds())
+}
+
+// Done records the attempts of a request and whether its last response was still a failure.
+func (m *Metrics) Done(attempts int, failed bool) {
+	if m == nil {
+		return
+	}
+
+	m.attempts.observe(float64(attempts))
+
+	if failed {
+		m.exhausted.add(1)
+	}
+}
+
+// MetricsRegistry exposes the metrics of the plugin instances in Prometheus text format.
+type MetricsRegistry struct {
+	mu      sync.Mutex
+	metrics map[string]*Metrics
+	servers map[string]*http.Server
+}
+
+// DefaultRegistry is shared by the plugin instances, so that they can be scraped from a single listener.
+var DefaultRegistry = &MetricsRegistry{
+	metrics: make(map[string]*Metrics),
+	servers: make(map[string]*http.Server),
+}
+
+// Register adds the metrics, replacing the ones of a previous instance with the same name.
+func (r *MetricsRegistry) Register(m *Metrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics[m.name] = m
+}
+
+// Listen serves the metrics on the address unless they are already served there.
+func (r *MetricsRegistry) Listen(addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.servers[addr]; ok {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("traefikretryplugin.Listen: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	r.servers[addr] = srv
+
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			r.mu.Lock()
+			delete(r.servers, addr)
+			r.mu.Unlock()
+		}
+	}()
+
+	return nil
+}
+
+func (r *MetricsRegistry) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	_, _ = r.WriteTo(rw)
+}
+
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+
+	ms := make([]*Metrics, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		ms = append(ms, m)
+	}
+
+	r.mu.Unlock()
+
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].name < ms[j].name
+	})
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	writeFamily(cw, "traefik_retry_requests_total", "counter", "Requests handled with a retry policy.")
+	for _, m := range ms {
+		writeSample(cw, "traefik_retry_requests_total", m.requests.value(), "middleware", m.name)
+	}
+
+	writeFamily(cw, "traefik_retry_retries_total", "counter", "Attempts discarded to be retried, by status code.")
+	for _, m := range ms {
+		codes, values := m.retries.values()
+		for _, code := range codes {
+			writeSample(cw, "traefik_retry_retries_total", values[code], "middleware", m.name, "code", strconv.Itoa(code))
+		}
+	}
+
+	writeFamily(cw, "traefik_retry_exhausted_total", "counter", "Requests answered with a failed response after the retries ran out or stopped.")
+	for _, m := range ms {
+		writeSample(cw, "traefik_retry_exhausted_total", m.exhausted.value(), "middleware", m.name)
+	}
+
+	writeFamily(cw, "traefik_retry_attempts", "histogram", "Attempts per request.")
+	for _, m := range ms {
+		writeHistogram(cw, "traefik_retry_attempts", m.attempts, m.name)
+	}
+
+	writeFamily(cw, "traefik_retry_body_buffer_bytes", "histogram", "Size of the request bodies buffered for retries.")
+	for _, m := range ms {
+		writeHistogram(cw, "traefik_retry_body_buffer_bytes", m.bodyBytes, m.name)
+	}
+
+	writeFamily(cw, "traefik_retry_backoff_seconds", "histogram", "Wait before the retried attempts.")
+	for _, m := range ms {
+		writeHistogram(cw, "traefik_retry_backoff_seconds", m.backoff, m.name)
+	}
+
+	if err := cw.w.Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+
+	return cw.n, cw.err
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) WriteString(s string) {
+	if c.err != nil {
+		return
+	}
+
+	n, err := c.w.WriteString(s)
+	c.n += int64(n)
+	c.err = err
+}
+
+func writeFamily(w *countingWriter, name, typ, help string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeHistogram(w *countingWriter, name string, h *histogram, middleware string) {
+	buckets, sum, count := h.snapshot()
+
+	for i, b := range h.bounds {
+		writeSample(w, name+"_bucket", buckets[i], "middleware", middleware, "le", formatFloat(b))
+	}
+
+	writeSample(w, name+"_bucket", count, "middleware", middleware, "le", "+Inf")
+	writeSample(w, name+"_sum", sum, "middleware", middleware)
+	writeSample(w, name+"_count", count, "middleware", middleware)
+}
+
+func writeSample(w *countingWriter, name string, v float64, labels ...string) {
+	var sb strings.Builder
+
+	sb.WriteString(name)
+	sb.WriteByte('{')
+
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(labels[i+1]))
+		sb.WriteByte('"')
+	}
+
+	sb.WriteString("} ")
+	sb.WriteString(formatFloat(v))
+	sb.WriteByte('\n')
+
+	w.WriteString(sb.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
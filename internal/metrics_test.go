@@ -0,0 +1,98 @@
+package traefikretryplugin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, h http.Handler) string {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %s, want the Prometheus text format", ct)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func TestMetricsScrape(t *testing.T) {
+	m := NewMetrics(`scrape "test"`)
+	DefaultRegistry.Register(m)
+
+	m.Request(2048)
+	m.Retry(503)
+	m.Retry(503)
+	m.Retry(502)
+	m.Wait(100 * time.Millisecond)
+	m.Wait(2 * time.Second)
+	m.Done(3, true)
+
+	body := scrape(t, DefaultRegistry)
+
+	for _, family := range []string{
+		"traefik_retry_requests_total counter",
+		"traefik_retry_retries_total counter",
+		"traefik_retry_exhausted_total counter",
+		"traefik_retry_attempts histogram",
+		"traefik_retry_body_buffer_bytes histogram",
+		"traefik_retry_backoff_seconds histogram",
+	} {
+		if !strings.Contains(body, "# TYPE "+family+"\n") {
+			t.Errorf("missing family %q", family)
+		}
+	}
+
+	const label = `middleware="scrape \"test\""`
+
+	for _, sample := range []string{
+		`traefik_retry_requests_total{` + label + `} 1`,
+		`traefik_retry_retries_total{` + label + `,code="502"} 1`,
+		`traefik_retry_retries_total{` + label + `,code="503"} 2`,
+		`traefik_retry_exhausted_total{` + label + `} 1`,
+		`traefik_retry_attempts_bucket{` + label + `,le="2"} 0`,
+		`traefik_retry_attempts_bucket{` + label + `,le="3"} 1`,
+		`traefik_retry_attempts_bucket{` + label + `,le="+Inf"} 1`,
+		`traefik_retry_attempts_sum{` + label + `} 3`,
+		`traefik_retry_attempts_count{` + label + `} 1`,
+		`traefik_retry_body_buffer_bytes_bucket{` + label + `,le="1024"} 0`,
+		`traefik_retry_body_buffer_bytes_bucket{` + label + `,le="16384"} 1`,
+		`traefik_retry_body_buffer_bytes_bucket{` + label + `,le="67108864"} 1`,
+		`traefik_retry_backoff_seconds_bucket{` + label + `,le="0.05"} 0`,
+		`traefik_retry_backoff_seconds_bucket{` + label + `,le="0.1"} 1`,
+		`traefik_retry_backoff_seconds_bucket{` + label + `,le="2.5"} 2`,
+		`traefik_retry_backoff_seconds_sum{` + label + `} 2.1`,
+		`traefik_retry_backoff_seconds_count{` + label + `} 2`,
+	} {
+		if !strings.Contains(body, "\n"+sample+"\n") {
+			t.Errorf("missing sample %s", sample)
+		}
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+
+	m.Request(1)
+	m.Retry(503)
+	m.Wait(time.Second)
+	m.Done(2, true)
+}
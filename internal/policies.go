@@ -1,62 +1,487 @@
 package traefikretryplugin
 
 import (
+	"errors"
 	"fmt"
 	. "github.com/atidev/golib/pkg/intervals"
 	. "github.com/atidev/golib/pkg/structuredheaders"
+	"net/http"
+	"strings"
+	"time"
 )
 
 type RetryPolicy struct {
 	codes    Interval
 	attempts int
+	backoff  Backoff
+	methods  methods
+	on       Failures
+	headers  HeaderMatchers
+	grpc     GRPCCodes
+
+	maxRetryAfter time.Duration
+	perTryTimeout time.Duration
+	deadline      time.Duration
+
+	mode       Mode
+	hedgeDelay time.Duration
+	parallel   int
+
+	maxAttempts int
+	maxParallel int
+}
+
+type Mode int
+
+const (
+	ModeSequential Mode = iota
+	ModeHedge
+)
+
+var modeNames = map[Mode]string{
+	ModeSequential: "sequential",
+	ModeHedge:      "hedge",
+}
+
+func (m Mode) String() string {
+	return modeNames[m]
+}
+
+func ParseMode(s string) (Mode, error) {
+	if s == "" {
+		return ModeSequential, nil
+	}
+
+	for m, name := range modeNames {
+		if strings.EqualFold(s, name) {
+			return m, nil
+		}
+	}
+
+	return ModeSequential, fmt.Errorf("traefikretryplugin.ParseMode: unknown mode `%s`", s)
+}
+
+const defaultParallel = 2
+
+// The Retry-Policy header comes from the client, so the attempts it asks for are capped by the configuration.
+const (
+	defaultMaxAttempts = 10
+	defaultMaxParallel = 5
+)
+
+const (
+	defaultMaxRetryAfter = 30 * time.Second
+	maxRetryAfterLimit   = 5 * time.Minute
+)
+
+// errHedgedGRPC rejects the gRPC mode along with the hedge mode, which commits the attempts by their header
+// and can't wait for the grpc-status sent in the trailers.
+var errHedgedGRPC = errors.New("grpc codes can't be used in hedge mode")
+
+type PolicyConfig struct {
+	Codes    string
+	Attempts int
+	Backoff  string
+	Jitter   string
+	Methods  []string
+	On       []string
+	Headers  []string
+	// GRPCCodes enables the gRPC mode retrying the calls which grpc-status is among the codes.
+	GRPCCodes []string
+
+	MaxRetryAfter string
+	PerTryTimeout string
+	Deadline      string
+
+	Mode       string
+	HedgeDelay string
+	Parallel   int
+
+	// MaxAttempts and MaxParallel cap the values of the Retry-Policy header.
+	MaxAttempts int
+	MaxParallel int
+}
+
+func NewPolicy(c PolicyConfig) (*RetryPolicy, error) {
+	codes, err := ParseCodes(c.Codes)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse codes: %w", err)
+	}
+
+	if c.Attempts < 0 {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: negative attempts: %d", c.Attempts)
+	}
+
+	backoff, err := ParseBackoff(c.Backoff)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse backoff: %w", err)
+	}
+
+	jitter, err := ParseJitter(c.Jitter)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse jitter: %w", err)
+	}
+
+	maxRetryAfter, err := parseDuration(c.MaxRetryAfter)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse max retry after: %w", err)
+	}
+
+	if maxRetryAfter, err = boundMaxRetryAfter(maxRetryAfter); err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: %w", err)
+	}
+
+	perTryTimeout, err := parseDuration(c.PerTryTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse per try timeout: %w", err)
+	}
+
+	deadline, err := parseDuration(c.Deadline)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse deadline: %w", err)
+	}
+
+	mode, err := ParseMode(c.Mode)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse mode: %w", err)
+	}
+
+	hedgeDelay, err := parseDuration(c.HedgeDelay)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse hedge delay: %w", err)
+	}
+
+	parallel := c.Parallel
+	if parallel == 0 {
+		parallel = defaultParallel
+	}
+
+	if parallel < 1 {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: parallel attempts must be positive: %d", parallel)
+	}
+
+	maxAttempts, err := boundLimit(c.MaxAttempts, c.Attempts, defaultMaxAttempts)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't bound attempts: %w", err)
+	}
+
+	maxParallel, err := boundLimit(c.MaxParallel, parallel, defaultMaxParallel)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't bound parallel: %w", err)
+	}
+
+	on, err := ParseFailures(c.On)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse failures: %w", err)
+	}
+
+	headers, err := ParseHeaderMatchers(c.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse headers: %w", err)
+	}
+
+	grpc, err := ParseGRPCCodes(c.GRPCCodes)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: can't parse grpc codes: %w", err)
+	}
+
+	if mode == ModeHedge && grpc != 0 {
+		return nil, fmt.Errorf("traefikretryplugin.NewPolicy: %w", errHedgedGRPC)
+	}
+
+	ms := c.Methods
+	if len(ms) == 0 {
+		ms = idempotentMethods
+	}
+
+	return &RetryPolicy{
+		codes:         codes,
+		attempts:      c.Attempts,
+		backoff:       backoff.WithJitter(jitter),
+		methods:       newMethods(ms),
+		on:            on,
+		headers:       headers,
+		grpc:          grpc,
+		maxRetryAfter: maxRetryAfter,
+		perTryTimeout: perTryTimeout,
+		deadline:      deadline,
+		mode:          mode,
+		hedgeDelay:    hedgeDelay,
+		parallel:      parallel,
+		maxAttempts:   maxAttempts,
+		maxParallel:   maxParallel,
+	}, nil
 }
 
 func (p *RetryPolicy) Applicable(status int) bool {
 	return p.codes.Includes(status)
 }
 
+// MatchesHeaders tells whether the response headers make the attempt retryable, whatever its status.
+func (p *RetryPolicy) MatchesHeaders(h http.Header) bool {
+	return p.headers.Match(h)
+}
+
+// GRPC tells whether the policy retries gRPC calls by their status.
+func (p *RetryPolicy) GRPC() bool {
+	return p.grpc != 0
+}
+
+// RetriesOnGRPC tells whether the grpc-status of the response, either in the trailers or in the header
+// of a trailers-only response, is retried.
+func (p *RetryPolicy) RetriesOnGRPC(header, trailer http.Header) bool {
+	code, ok := grpcStatus(header, trailer)
+
+	return ok && p.grpc.Includes(code)
+}
+
 func (p *RetryPolicy) CanRetry(attempt int) bool {
 	return attempt < p.attempts
 }
 
+// HandlesFailures tells whether transport failures are retried by their class instead of the status code.
+func (p *RetryPolicy) HandlesFailures() bool {
+	return p.on != FailureNone
+}
+
+func (p *RetryPolicy) RetriesOn(f Failures) bool {
+	return p.on.Includes(f)
+}
+
+// AllowsMethod tells whether requests of the method may be retried. Methods outside of the list
+// are still retried when they're not idempotent by definition but the request has an idempotency key.
+func (p *RetryPolicy) AllowsMethod(method string, idempotencyKey bool) bool {
+	return p.methods.includes(method) || idempotencyKey && !isIdempotent(method)
+}
+
+// AcceptsRetryAfter tells whether the delay requested by the upstream fits the cap.
+func (p *RetryPolicy) AcceptsRetryAfter(d time.Duration) bool {
+	return d <= p.maxRetryAfter
+}
+
+func (p *RetryPolicy) Hedged() bool {
+	return p.mode == ModeHedge
+}
+
+// PerTryTimeout is the time limit of a single attempt, zero means no limit.
+func (p *RetryPolicy) PerTryTimeout() time.Duration {
+	return p.perTryTimeout
+}
+
+// Deadline is the time since the first attempt no attempt may start after, zero means no deadline.
+func (p *RetryPolicy) Deadline() time.Duration {
+	return p.deadline
+}
+
+func (p *RetryPolicy) Delay(attempt int, prev time.Duration) time.Duration {
+	return p.backoff.Delay(attempt, prev)
+}
+
 func (p *RetryPolicy) String() string {
-	return fmt.Sprintf("Policy: codes: %s, attempts: %d", p.codes.String(), p.attempts)
+	return fmt.Sprintf("Policy: codes: %s, attempts: %d, backoff: %s, methods: %s, on: %s, headers: %s, "+
+		"grpc codes: %s, max retry after: %s, per try timeout: %s, deadline: %s, mode: %s, hedge delay: %s, parallel: %d",
+		p.codes.String(), p.attempts, p.backoff.String(), p.methods.String(), p.on.String(), p.headers.String(),
+		p.grpc.String(), p.maxRetryAfter, p.perTryTimeout, p.deadline, p.mode, p.hedgeDelay, p.parallel)
 }
 
-func ParsePolicy(hp map[string]ListItem) (*RetryPolicy, error) {
-	codes, err := parseCodes(hp)
-	if err != nil {
-		return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse codes: %w", err)
+// ParsePolicy reads the policy from the header dictionary. Keys missing from the
+// dictionary are taken from the base policy, which may be nil.
+func ParsePolicy(hp map[string]ListItem, base *RetryPolicy) (*RetryPolicy, error) {
+	var pl RetryPolicy
+
+	if base != nil {
+		pl = *base
+	} else {
+		empty, err := NewPolicy(PolicyConfig{})
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: %w", err)
+		}
+
+		pl = *empty
 	}
 
-	attempts, err := parseAttempts(hp)
-	if err != nil {
-		return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse attempts: %w", err)
+	if _, ok := hp["codes"]; ok {
+		codes, err := parseCodes(hp)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse codes: %w", err)
+		}
+
+		pl.codes = codes
 	}
 
-	return &RetryPolicy{
-		codes:    codes,
-		attempts: attempts,
-	}, nil
+	if _, ok := hp["attempts"]; ok {
+		attempts, err := parseAttempts(hp)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse attempts: %w", err)
+		}
+
+		pl.attempts = atMost(attempts, pl.maxAttempts)
+	}
+
+	if _, ok := hp["backoff"]; ok {
+		backoff, err := parseBackoff(hp)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse backoff: %w", err)
+		}
+
+		pl.backoff = backoff.WithJitter(pl.backoff.jitter)
+	}
+
+	if _, ok := hp["jitter"]; ok {
+		jitter, err := parseJitter(hp)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse jitter: %w", err)
+		}
+
+		pl.backoff = pl.backoff.WithJitter(jitter)
+	}
+
+	if _, ok := hp["methods"]; ok {
+		ms, err := parseMethods(hp)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse methods: %w", err)
+		}
+
+		pl.methods = ms
+	}
+
+	if _, ok := hp["on"]; ok {
+		tokens, err := parseTokens(hp, "on")
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse failures: %w", err)
+		}
+
+		on, err := ParseFailures(tokens)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse failures: %w", err)
+		}
+
+		pl.on = on
+	}
+
+	if _, ok := hp["headers"]; ok {
+		specs, err := parseStrings(hp, "headers")
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse headers: %w", err)
+		}
+
+		headers, err := ParseHeaderMatchers(specs)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse headers: %w", err)
+		}
+
+		pl.headers = headers
+	}
+
+	if _, ok := hp["grpc-codes"]; ok {
+		tokens, err := parseTokens(hp, "grpc-codes")
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse grpc codes: %w", err)
+		}
+
+		grpc, err := ParseGRPCCodes(tokens)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse grpc codes: %w", err)
+		}
+
+		pl.grpc = grpc
+	}
+
+	if _, ok := hp["max-retry-after"]; ok {
+		maxRetryAfter, err := parseDurationItem(hp, "max-retry-after")
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse max retry after: %w", err)
+		}
+
+		if maxRetryAfter, err = boundMaxRetryAfter(maxRetryAfter); err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: %w", err)
+		}
+
+		pl.maxRetryAfter = maxRetryAfter
+	}
+
+	if _, ok := hp["per-try-timeout"]; ok {
+		perTryTimeout, err := parseDurationItem(hp, "per-try-timeout")
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse per try timeout: %w", err)
+		}
+
+		pl.perTryTimeout = perTryTimeout
+	}
+
+	if _, ok := hp["deadline"]; ok {
+		deadline, err := parseDurationItem(hp, "deadline")
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse deadline: %w", err)
+		}
+
+		pl.deadline = deadline
+	}
+
+	if _, ok := hp["mode"]; ok {
+		mode, err := parseMode(hp)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse mode: %w", err)
+		}
+
+		pl.mode = mode
+	}
+
+	if _, ok := hp["hedge-delay"]; ok {
+		hedgeDelay, err := parseDurationItem(hp, "hedge-delay")
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse hedge delay: %w", err)
+		}
+
+		pl.hedgeDelay = hedgeDelay
+	}
+
+	if _, ok := hp["parallel"]; ok {
+		parallel, err := parseInteger(hp, "parallel")
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: can't parse parallel: %w", err)
+		}
+
+		if parallel < 1 {
+			return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: parallel attempts must be positive: %d", parallel)
+		}
+
+		pl.parallel = atMost(parallel, pl.maxParallel)
+	}
+
+	if pl.Hedged() && pl.GRPC() {
+		return nil, fmt.Errorf("traefikretryplugin.ParsePolicy: %w", errHedgedGRPC)
+	}
+
+	return &pl, nil
 }
 
 func parseAttempts(hp map[string]ListItem) (int, error) {
-	a, err := hp["attempts"].Item()
+	attempts, err := parseInteger(hp, "attempts")
 	if err != nil {
-		return 0, fmt.Errorf("traefikretryplugin.parseAttempts: can't parse item: %w", err)
+		return 0, fmt.Errorf("traefikretryplugin.parseAttempts: %w", err)
+	}
+
+	return attempts, nil
+}
+
+func parseInteger(hp map[string]ListItem, key string) (int, error) {
+	a, err := hp[key].Item()
+	if err != nil {
+		return 0, fmt.Errorf("traefikretryplugin.parseInteger: can't parse item: %w", err)
 	}
 
 	as, err := a.Number()
 	if err != nil {
-		return 0, fmt.Errorf("traefikretryplugin.parseAttempts: can't parse number: %w", err)
+		return 0, fmt.Errorf("traefikretryplugin.parseInteger: can't parse number: %w", err)
 	}
 
-	attempts, err := as.Integer()
+	i, err := as.Integer()
 	if err != nil {
-		return 0, fmt.Errorf("traefikretryplugin.parseAttempts: can't parse integer %w", err)
+		return 0, fmt.Errorf("traefikretryplugin.parseInteger: can't parse integer %w", err)
 	}
 
-	return attempts, nil
+	return i, nil
 }
 
 func parseCodes(hp map[string]ListItem) (Interval, error) {
@@ -65,15 +490,224 @@ func parseCodes(hp map[string]ListItem) (Interval, error) {
 		return nil, fmt.Errorf("traefikretryplugin.parseCodes: can't parse item: %w", err)
 	}
 
+	// a single alias may be given as a token
 	cs, err := c.Str()
 	if err != nil {
-		return nil, fmt.Errorf("traefikretryplugin.parseCodes can't parse string: %w", err)
+		if cs, err = c.Token(); err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.parseCodes can't parse string: %w", err)
+		}
 	}
 
-	codes, err := NewInterval(cs)
+	codes, err := ParseCodes(cs)
 	if err != nil {
 		return nil, fmt.Errorf("traefikretryplugin.parseCodes: can't parse range: %w", err)
 	}
 
 	return codes, nil
 }
+
+func parseBackoff(hp map[string]ListItem) (Backoff, error) {
+	b, err := hp["backoff"].Item()
+	if err != nil {
+		return Backoff{}, fmt.Errorf("traefikretryplugin.parseBackoff: can't parse item: %w", err)
+	}
+
+	bs, err := b.Str()
+	if err != nil {
+		return Backoff{}, fmt.Errorf("traefikretryplugin.parseBackoff: can't parse string: %w", err)
+	}
+
+	backoff, err := ParseBackoff(bs)
+	if err != nil {
+		return Backoff{}, fmt.Errorf("traefikretryplugin.parseBackoff: %w", err)
+	}
+
+	return backoff, nil
+}
+
+func parseJitter(hp map[string]ListItem) (Jitter, error) {
+	j, err := hp["jitter"].Item()
+	if err != nil {
+		return JitterNone, fmt.Errorf("traefikretryplugin.parseJitter: can't parse item: %w", err)
+	}
+
+	js, err := j.Token()
+	if err != nil {
+		return JitterNone, fmt.Errorf("traefikretryplugin.parseJitter: can't parse token: %w", err)
+	}
+
+	jitter, err := ParseJitter(js)
+	if err != nil {
+		return JitterNone, fmt.Errorf("traefikretryplugin.parseJitter: %w", err)
+	}
+
+	return jitter, nil
+}
+
+// boundMaxRetryAfter defaults the cap of the Retry-After delays and rejects the caps over the limit,
+// the client request is held for the whole delay.
+func boundMaxRetryAfter(d time.Duration) (time.Duration, error) {
+	if d == 0 {
+		return defaultMaxRetryAfter, nil
+	}
+
+	if d > maxRetryAfterLimit {
+		return 0, fmt.Errorf("traefikretryplugin.boundMaxRetryAfter: max retry after `%s` is over %s", d, maxRetryAfterLimit)
+	}
+
+	return d, nil
+}
+
+// boundLimit checks the cap of a value of the Retry-Policy header against the configured value.
+// Unset, it's the default unless the configured value is higher.
+func boundLimit(limit, value, def int) (int, error) {
+	if limit < 0 {
+		return 0, fmt.Errorf("traefikretryplugin.boundLimit: negative limit: %d", limit)
+	}
+
+	if limit == 0 {
+		if value > def {
+			return value, nil
+		}
+
+		return def, nil
+	}
+
+	if value > limit {
+		return 0, fmt.Errorf("traefikretryplugin.boundLimit: %d is over the limit of %d", value, limit)
+	}
+
+	return limit, nil
+}
+
+func atMost(n, limit int) int {
+	if n > limit {
+		return limit
+	}
+
+	return n
+}
+
+func parseDurationItem(hp map[string]ListItem, key string) (time.Duration, error) {
+	i, err := hp[key].Item()
+	if err != nil {
+		return 0, fmt.Errorf("traefikretryplugin.parseDurationItem: can't parse item: %w", err)
+	}
+
+	is, err := i.Str()
+	if err != nil {
+		return 0, fmt.Errorf("traefikretryplugin.parseDurationItem: can't parse string: %w", err)
+	}
+
+	d, err := parseDuration(is)
+	if err != nil {
+		return 0, fmt.Errorf("traefikretryplugin.parseDurationItem: %w", err)
+	}
+
+	return d, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("traefikretryplugin.parseDuration: %w", err)
+	}
+
+	if d < 0 {
+		return 0, fmt.Errorf("traefikretryplugin.parseDuration: negative duration `%s`", s)
+	}
+
+	return d, nil
+}
+
+func parseMethods(hp map[string]ListItem) (methods, error) {
+	tokens, err := parseTokens(hp, "methods")
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.parseMethods: %w", err)
+	}
+
+	return newMethods(tokens), nil
+}
+
+// parseTokens reads either a single token or an inner list of tokens.
+func parseTokens(hp map[string]ListItem, key string) ([]string, error) {
+	if i, err := hp[key].Item(); err == nil {
+		t, err := i.Token()
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.parseTokens: can't parse token: %w", err)
+		}
+
+		return []string{t}, nil
+	}
+
+	l, err := hp[key].InnerList()
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.parseTokens: can't parse inner list: %w", err)
+	}
+
+	tokens := make([]string, 0, len(l.Items()))
+
+	for _, i := range l.Items() {
+		t, err := i.Token()
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.parseTokens: can't parse token: %w", err)
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	return tokens, nil
+}
+
+// parseStrings reads either a single string or an inner list of strings.
+func parseStrings(hp map[string]ListItem, key string) ([]string, error) {
+	if i, err := hp[key].Item(); err == nil {
+		s, err := i.Str()
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.parseStrings: can't parse string: %w", err)
+		}
+
+		return []string{s}, nil
+	}
+
+	l, err := hp[key].InnerList()
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.parseStrings: can't parse inner list: %w", err)
+	}
+
+	strs := make([]string, 0, len(l.Items()))
+
+	for _, i := range l.Items() {
+		s, err := i.Str()
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.parseStrings: can't parse string: %w", err)
+		}
+
+		strs = append(strs, s)
+	}
+
+	return strs, nil
+}
+
+func parseMode(hp map[string]ListItem) (Mode, error) {
+	m, err := hp["mode"].Item()
+	if err != nil {
+		return ModeSequential, fmt.Errorf("traefikretryplugin.parseMode: can't parse item: %w", err)
+	}
+
+	ms, err := m.Token()
+	if err != nil {
+		return ModeSequential, fmt.Errorf("traefikretryplugin.parseMode: can't parse token: %w", err)
+	}
+
+	mode, err := ParseMode(ms)
+	if err != nil {
+		return ModeSequential, fmt.Errorf("traefikretryplugin.parseMode: %w", err)
+	}
+
+	return mode, nil
+}
@@ -0,0 +1,39 @@
+package traefikretryplugin
+
+import (
+	"testing"
+)
+
+func TestHeaderLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   PolicyConfig
+		header   string
+		attempts int
+		parallel int
+	}{
+		{name: "default caps", header: "attempts=100, parallel=100", attempts: defaultMaxAttempts, parallel: defaultMaxParallel},
+		{name: "within caps", header: "attempts=3, parallel=3", attempts: 3, parallel: 3},
+		{name: "configured caps", config: PolicyConfig{MaxAttempts: 3, MaxParallel: 2}, header: "attempts=5, parallel=5", attempts: 3, parallel: 2},
+		{name: "configured values over the default caps", config: PolicyConfig{Attempts: 20, Parallel: 8}, header: "attempts=30, parallel=30", attempts: 20, parallel: 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl, err := parsePolicyHeader(t, tt.header, newTestPolicy(t, tt.config))
+			if err != nil {
+				t.Fatalf("ParsePolicy(%q): %v", tt.header, err)
+			}
+
+			if pl.attempts != tt.attempts || pl.parallel != tt.parallel {
+				t.Errorf("attempts %d, parallel %d, want %d, %d", pl.attempts, pl.parallel, tt.attempts, tt.parallel)
+			}
+		})
+	}
+
+	for _, c := range []PolicyConfig{{Attempts: 3, MaxAttempts: 2}, {Parallel: 3, MaxParallel: 2}, {MaxAttempts: -1}} {
+		if _, err := NewPolicy(c); err == nil {
+			t.Errorf("NewPolicy(%+v) doesn't fail", c)
+		}
+	}
+}
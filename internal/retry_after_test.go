@@ -0,0 +1,76 @@
+package traefikretryplugin
+
+import (
+	. "github.com/atidev/golib/pkg/structuredheaders"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		v    string
+		want time.Duration
+		ok   bool
+	}{
+		{v: "120", want: 2 * time.Minute, ok: true},
+		{v: " 0 ", ok: true},
+		{v: "99999999999", want: math.MaxInt64, ok: true},
+		{v: now.Add(90 * time.Second).Format(http.TimeFormat), want: 90 * time.Second, ok: true},
+		{v: now.Add(-time.Hour).Format(http.TimeFormat), ok: true},
+		{v: "-1"},
+		{v: ""},
+		{v: "soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.v, func(t *testing.T) {
+			d, ok := ParseRetryAfter(tt.v, now)
+			if d != tt.want || ok != tt.ok {
+				t.Errorf("ParseRetryAfter(%q) = %s, %v, want %s, %v", tt.v, d, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// parsePolicyHeader reads the policy of the Retry-Policy header value over the base policy.
+func parsePolicyHeader(t *testing.T, v string, base *RetryPolicy) (*RetryPolicy, error) {
+	t.Helper()
+
+	h := http.Header{"Retry-Policy": {v}}
+
+	hp, err := NewStructuredHeader(h).Dictionary("Retry-Policy")
+	if err != nil {
+		t.Fatalf("can't parse %q: %v", v, err)
+	}
+
+	return ParsePolicy(hp, base)
+}
+
+func TestMaxRetryAfter(t *testing.T) {
+	pl := newTestPolicy(t, PolicyConfig{})
+
+	if !pl.AcceptsRetryAfter(defaultMaxRetryAfter) || pl.AcceptsRetryAfter(defaultMaxRetryAfter+time.Second) {
+		t.Errorf("the default policy doesn't cap the delays at %s", defaultMaxRetryAfter)
+	}
+
+	if d, _ := ParseRetryAfter("99999999999", time.Now()); pl.AcceptsRetryAfter(d) {
+		t.Error("the overflowing delay was accepted")
+	}
+
+	if _, err := NewPolicy(PolicyConfig{MaxRetryAfter: "6m"}); err == nil {
+		t.Error("NewPolicy accepted a max retry after over the limit")
+	}
+
+	hpl, err := parsePolicyHeader(t, `max-retry-after="5m"`, pl)
+	if err != nil || !hpl.AcceptsRetryAfter(5*time.Minute) {
+		t.Errorf("ParsePolicy() = %v, want the max retry after of 5m", err)
+	}
+
+	if _, err = parsePolicyHeader(t, `max-retry-after="24h"`, pl); err == nil {
+		t.Error("ParsePolicy accepted a max retry after over the limit")
+	}
+}
@@ -0,0 +1,61 @@
+package traefikretryplugin
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryInfo collects the retries of a request for the Retry-Info header. A nil info collects nothing.
+type RetryInfo struct {
+	// Discarded lists the statuses of the retried attempts.
+	Discarded []int
+	// Backoff is the total wait before the retried attempts.
+	Backoff time.Duration
+}
+
+func (ri *RetryInfo) Retried(status int, delay time.Duration) {
+	if ri == nil {
+		return
+	}
+
+	ri.Discarded = append(ri.Discarded, status)
+	ri.Backoff += delay
+}
+
+// Header formats the info as the structured dictionary, eg:
+// attempts=3, discarded=(503 503), backoff=0.3, stopped=success.
+func (ri *RetryInfo) Header(attempts int, stopped string) string {
+	var sb strings.Builder
+
+	sb.WriteString("attempts=")
+	sb.WriteString(strconv.Itoa(attempts))
+	sb.WriteString(", discarded=(")
+
+	for i, status := range ri.Discarded {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+
+		sb.WriteString(strconv.Itoa(status))
+	}
+
+	sb.WriteString("), backoff=")
+	sb.WriteString(formatDecimal(ri.Backoff))
+	sb.WriteString(", stopped=")
+	sb.WriteString(stopped)
+
+	return sb.String()
+}
+
+// formatDecimal formats the duration as the decimal seconds with milliseconds precision.
+func formatDecimal(d time.Duration) string {
+	ms := d.Milliseconds()
+	frac := strings.TrimRight(strconv.FormatInt(1000+ms%1000, 10)[1:], "0")
+
+	if frac == "" {
+		frac = "0"
+	}
+
+	return strconv.FormatInt(ms/1000, 10) + "." + frac
+}
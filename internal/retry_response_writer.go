@@ -1,59 +1,561 @@
 package traefikretryplugin
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
-func NewRetryResponseWriter(rw http.ResponseWriter, policy *RetryPolicy, attempt int) *RetryResponseWriter {
+func NewRetryResponseWriter(rw http.ResponseWriter, policy *RetryPolicy, attempt Attempt) *RetryResponseWriter {
 	return &RetryResponseWriter{
 		rw:      rw,
 		policy:  policy,
 		attempt: attempt,
+		header:  make(http.Header),
 	}
 }
 
 type RetryResponseWriter struct {
-	rw       http.ResponseWriter
-	policy   *RetryPolicy
-	Retrying bool
+	rw         http.ResponseWriter
+	policy     *RetryPolicy
+	Retrying   bool
+	RetryAfter time.Duration
+	// Delay is the wait before the next attempt, set along with Retrying.
+	Delay    time.Duration
 	writing  bool
-	attempt  int
+	hijacked bool
+	attempt  Attempt
+	header   http.Header
+	status   int
+	failed   bool
+	reason   string
+	// stopped tells why a retryable response is committed, empty unless retries were cut short.
+	stopped string
+	// outcome tells why the attempt is committed.
+	outcome string
+	// held buffers the body of the attempt inspected before the commit, nil unless the body is inspected.
+	held *bytes.Buffer
+	// trailer holds the fields set after the held attempt wrote its header.
+	trailer http.Header
 }
 
-func (w *RetryResponseWriter) shouldRetry(status int) bool {
-	return w.policy != nil && w.policy.Applicable(status) && w.policy.CanRetry(w.attempt)
+const (
+	stoppedByBudget     = "budget"
+	stoppedByBreaker    = "circuit-open"
+	stoppedBySuccess    = "success"
+	stoppedByExhaustion = "exhausted"
+	stoppedByDeadline   = "deadline"
+	stoppedByRetryAfter = "retry-after"
+	stoppedByHijack     = "hijacked"
+	stoppedByPushback   = "pushback"
+	stoppedByMethod     = "method"
+
+	reasonStatus  = "status"
+	reasonTimeout = "per-try-timeout"
+	reasonHeader  = "header"
+	reasonBody    = "body"
+	reasonGRPC    = "grpc-status"
+)
+
+// shouldRetry tells whether the failed attempt is retried.
+func (w *RetryResponseWriter) shouldRetry() bool {
+	if w.hijacked {
+		w.outcome = stoppedByHijack
+		return false
+	}
+
+	if w.attempt.GRPCOnly && w.reason != reasonGRPC {
+		w.outcome = stoppedByMethod
+		return false
+	}
+
+	if !w.policy.CanRetry(w.attempt.Number) {
+		w.outcome = stoppedByExhaustion
+		return false
+	}
+
+	delay := w.policy.Delay(w.attempt.Number, w.attempt.PrevDelay)
+
+	// the pushback of the gRPC server replaces the backoff
+	if d, retry, ok := grpcPushback(w.header, w.trailer); ok && w.attempt.GRPC {
+		if !retry {
+			w.outcome = stoppedByPushback
+			return false
+		}
+
+		if !w.policy.AcceptsRetryAfter(d) {
+			w.outcome = stoppedByRetryAfter
+			return false
+		}
+
+		delay = d
+	}
+
+	if d, ok := ParseRetryAfter(w.header.Get("Retry-After"), time.Now()); ok {
+		if !w.policy.AcceptsRetryAfter(d) {
+			w.outcome = stoppedByRetryAfter
+			return false
+		}
+
+		w.RetryAfter = d
+
+		if d > delay {
+			delay = d
+		}
+	}
+
+	if !w.attempt.startsBefore(delay) {
+		w.outcome = stoppedByDeadline
+		return false
+	}
+
+	if !w.attempt.Breaker.AllowsRetries() {
+		w.stopped = stoppedByBreaker
+		w.outcome = w.stopped
+		return false
+	}
+
+	if !w.attempt.Budget.Withdraw() {
+		w.stopped = stoppedByBudget
+		w.outcome = w.stopped
+		return false
+	}
+
+	w.Delay = delay
+
+	return true
+}
+
+func (w *RetryResponseWriter) retryable(status int) bool {
+	failed, reason := w.attempt.classify(w.policy, status, w.header)
+	w.reason = reason
+
+	return failed
+}
+
+// Status is the final status of the attempt, zero until the handler writes it.
+func (w *RetryResponseWriter) Status() int {
+	return w.status
+}
+
+// Attempt is the number of the attempt, zero for the first one.
+func (w *RetryResponseWriter) Attempt() int {
+	return w.attempt.Number
+}
+
+// Failed tells whether the attempt is a failure according to the policy, even if it's committed.
+func (w *RetryResponseWriter) Failed() bool {
+	return w.failed
+}
+
+// Reason tells why the attempt failed: the per try timeout, the transport failure, the grpc-status, the header,
+// the status or the body.
+// It's empty unless the attempt failed.
+func (w *RetryResponseWriter) Reason() string {
+	if !w.failed {
+		return ""
+	}
+
+	return w.reason
+}
+
+// Stopped tells why the retries were cut short, empty unless they were.
+func (w *RetryResponseWriter) Stopped() string {
+	return w.stopped
 }
 
 func (w *RetryResponseWriter) Header() http.Header {
+	if w.held != nil {
+		return w.trailer
+	}
+
 	if !w.writing {
-		return make(http.Header)
+		return w.header
 	}
 
 	return w.rw.Header()
 }
 
 func (w *RetryResponseWriter) WriteHeader(status int) {
-	if w.shouldRetry(status) {
+	if w.writing || w.Retrying || w.held != nil {
+		return
+	}
+
+	// the interim response carries the attempt's header, which is taken back afterwards
+	// since the final response may come from another attempt
+	if isInformational(status) {
+		h := w.rw.Header()
+		prev := make(http.Header, len(w.header))
+
+		for k, v := range w.header {
+			if pv, ok := h[k]; ok {
+				prev[k] = pv
+			}
+
+			h[k] = v
+		}
+
+		w.rw.WriteHeader(status)
+
+		for k := range w.header {
+			if pv, ok := prev[k]; ok {
+				h[k] = pv
+			} else {
+				delete(h, k)
+			}
+		}
+
+		return
+	}
+
+	w.status = status
+
+	w.failed = w.policy != nil && w.retryable(status)
+
+	// the body of an acceptable response is held to be inspected, the last attempt included
+	// so that the breaker and the diagnostics account it
+	if !w.failed && w.holds() {
+		w.held = new(bytes.Buffer)
+		w.trailer = make(http.Header)
+
+		return
+	}
+
+	w.decide()
+}
+
+// holds tells whether the response is held until the handler finishes, either to inspect its body
+// or to read the grpc-status from the trailers. Encoded bodies aren't inspected.
+func (w *RetryResponseWriter) holds() bool {
+	if w.policy == nil || w.hijacked {
+		return false
+	}
+
+	if _, ok := grpcStatus(w.header, nil); !ok && w.attempt.GRPC {
+		return true
+	}
+
+	return w.attempt.Body != nil && !encoded(w.header)
+}
+
+// decide either retries the failed attempt or commits it.
+func (w *RetryResponseWriter) decide() {
+	w.attempt.Breaker.Record(w.failed)
+
+	if w.failed && w.shouldRetry() {
 		w.Retrying = true
 		return
 	}
 
 	w.writing = true
 
+	if !w.failed {
+		w.outcome = stoppedBySuccess
+	}
+
 	h := w.Header()
 
-	if w.attempt > 0 {
-		h.Add("Retry-Attempt", strconv.Itoa(w.attempt))
+	for k, v := range w.header {
+		h[k] = v
+	}
+
+	if w.attempt.Number > 0 {
+		h.Add("Retry-Attempt", strconv.Itoa(w.attempt.Number))
+	}
+
+	if w.stopped != "" {
+		h.Set("Retry-Stopped", w.stopped)
+	}
+
+	if w.attempt.Info != nil {
+		h.Set("Retry-Info", w.attempt.Info.Header(w.attempt.Number+1, w.outcome))
+	}
+
+	w.rw.WriteHeader(w.status)
+}
+
+// release commits the held attempt without inspecting it, its body is sent first.
+func (w *RetryResponseWriter) release() error {
+	held := w.held
+	w.held = nil
+
+	w.decide()
+
+	if err := w.writeHeld(held); err != nil {
+		return fmt.Errorf("traefikretryplugin.release: %w", err)
+	}
+
+	return nil
+}
+
+// inspect decides on the held attempt by its body and its trailers.
+func (w *RetryResponseWriter) inspect() {
+	held := w.held
+	w.held = nil
+
+	switch {
+	case w.policy.RetriesOnGRPC(w.header, w.trailer):
+		w.failed = true
+		w.reason = reasonGRPC
+	case w.attempt.Body != nil && w.attempt.Body.Match(held.Bytes()):
+		w.failed = true
+		w.reason = reasonBody
+	}
+
+	w.decide()
+
+	if w.writing {
+		_ = w.writeHeld(held)
+	}
+}
+
+// writeHeld sends the held body of the committed attempt, then the trailers set so far.
+func (w *RetryResponseWriter) writeHeld(held *bytes.Buffer) error {
+	if _, err := w.rw.Write(held.Bytes()); err != nil {
+		return err
+	}
+
+	h := w.rw.Header()
+
+	for k, v := range w.trailer {
+		h[k] = v
 	}
 
-	w.rw.WriteHeader(status)
+	return nil
 }
 
+// Write commits the implicit 200 status first, like the standard writer does.
 func (w *RetryResponseWriter) Write(body []byte) (int, error) {
+	if !w.writing && !w.Retrying && w.held == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.held != nil {
+		if int64(w.held.Len()+len(body)) <= w.attempt.BufferSize {
+			return w.held.Write(body)
+		}
+
+		// the body too large to be inspected is committed as is
+		if err := w.release(); err != nil {
+			return 0, err
+		}
+	}
+
 	if w.Retrying {
 		return len(body), nil
 	}
 
 	return w.rw.Write(body)
 }
+
+// Finish commits the implicit 200 of a handler that returned without writing,
+// and decides on the attempt which body is held to be inspected.
+func (w *RetryResponseWriter) Finish() {
+	if !w.writing && !w.Retrying && !w.hijacked && w.held == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// the attempt hijacked before writing a response isn't accounted by the breaker
+	if w.hijacked && !w.writing {
+		w.attempt.Breaker.Release()
+	}
+
+	if w.held != nil {
+		w.inspect()
+	}
+}
+
+// flush commits the attempt, the same way flushing the standard writer sends the header.
+// The held attempt is committed as is, like the one over the buffer, so that streams aren't stalled.
+func (w *RetryResponseWriter) flush() error {
+	if !w.writing && !w.Retrying && w.held == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.held != nil {
+		if err := w.release(); err != nil {
+			return fmt.Errorf("traefikretryplugin.flush: %w", err)
+		}
+	}
+
+	if w.Retrying {
+		return nil
+	}
+
+	if err := http.NewResponseController(w.rw).Flush(); err != nil {
+		return fmt.Errorf("traefikretryplugin.flush: %w", err)
+	}
+
+	return nil
+}
+
+// hijack hands the connection over to the handler, so the attempt can't be retried anymore.
+func (w *RetryResponseWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.Retrying {
+		return nil, nil, errors.New("traefikretryplugin.hijack: attempt is being retried")
+	}
+
+	if w.held != nil {
+		if err := w.release(); err != nil {
+			return nil, nil, fmt.Errorf("traefikretryplugin.hijack: %w", err)
+		}
+	}
+
+	w.hijacked = true
+
+	return http.NewResponseController(w.rw).Hijack()
+}
+
+// ReadFrom copies with the wrapped writer once the attempt is committed, and falls back to io.Copy
+// when the wrapped writer has no ReadFrom.
+func (w *RetryResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.Retrying {
+		return io.Copy(io.Discard, src)
+	}
+
+	if !w.writing {
+		return io.Copy(writerOnly{w}, src)
+	}
+
+	if rf, ok := w.rw.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+
+	return io.Copy(writerOnly{w.rw}, src)
+}
+
+// Unwrap allows http.ResponseController to reach the wrapped writer.
+func (w *RetryResponseWriter) Unwrap() http.ResponseWriter {
+	return w.rw
+}
+
+// Writer is the writer passed to the handler. It implements http.Flusher and http.Hijacker
+// only when the wrapped writer does, directly or through Unwrap, so that the handler can tell what
+// the connection supports. http.ResponseController stops at the writer implementing them, so that
+// flushing commits the attempt and hijacking stops the retries whichever way they're called.
+func (w *RetryResponseWriter) Writer() http.ResponseWriter {
+	flusher := reaches(w.rw, func(rw http.ResponseWriter) bool {
+		_, f := rw.(http.Flusher)
+		_, fe := rw.(interface{ FlushError() error })
+
+		return f || fe
+	})
+
+	hijacker := reaches(w.rw, func(rw http.ResponseWriter) bool {
+		_, h := rw.(http.Hijacker)
+
+		return h
+	})
+
+	switch {
+	case flusher && hijacker:
+		return flushHijackWriter{retryWriter{w}}
+	case flusher:
+		return flushWriter{retryWriter{w}}
+	case hijacker:
+		return hijackWriter{retryWriter{w}}
+	default:
+		return retryWriter{w}
+	}
+}
+
+// retryWriter hides the methods of RetryResponseWriter that aren't part of the writer.
+type retryWriter struct {
+	w *RetryResponseWriter
+}
+
+func (r retryWriter) Header() http.Header {
+	return r.w.Header()
+}
+
+func (r retryWriter) Write(body []byte) (int, error) {
+	return r.w.Write(body)
+}
+
+func (r retryWriter) WriteHeader(status int) {
+	r.w.WriteHeader(status)
+}
+
+func (r retryWriter) ReadFrom(src io.Reader) (int64, error) {
+	return r.w.ReadFrom(src)
+}
+
+func (r retryWriter) Unwrap() http.ResponseWriter {
+	return r.w.Unwrap()
+}
+
+// reaches tells whether the writer or one it wraps satisfies ok, following Unwrap like http.ResponseController.
+func reaches(rw http.ResponseWriter, ok func(http.ResponseWriter) bool) bool {
+	for {
+		if ok(rw) {
+			return true
+		}
+
+		u, wraps := rw.(interface{ Unwrap() http.ResponseWriter })
+		if !wraps {
+			return false
+		}
+
+		rw = u.Unwrap()
+	}
+}
+
+type flushWriter struct {
+	retryWriter
+}
+
+func (f flushWriter) Flush() {
+	_ = f.w.flush()
+}
+
+func (f flushWriter) FlushError() error {
+	return f.w.flush()
+}
+
+type hijackWriter struct {
+	retryWriter
+}
+
+func (h hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.w.hijack()
+}
+
+type flushHijackWriter struct {
+	retryWriter
+}
+
+func (f flushHijackWriter) Flush() {
+	_ = f.w.flush()
+}
+
+func (f flushHijackWriter) FlushError() error {
+	return f.w.flush()
+}
+
+func (f flushHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return f.w.hijack()
+}
+
+// encoded tells whether the body has a content coding, eg: gzip, which the predicates can't read.
+func encoded(h http.Header) bool {
+	ce := strings.TrimSpace(h.Get("Content-Encoding"))
+
+	return ce != "" && !strings.EqualFold(ce, "identity")
+}
+
+// isInformational reports 1xx statuses that precede the final one.
+func isInformational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
+// writerOnly hides ReadFrom of the writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
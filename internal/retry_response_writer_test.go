@@ -0,0 +1,375 @@
+package traefikretryplugin
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// plainWriter is a writer which supports neither flushing nor hijacking.
+type plainWriter struct {
+	header http.Header
+	status int
+	body   []byte
+}
+
+func (w *plainWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *plainWriter) Write(b []byte) (int, error) {
+	w.body = append(w.body, b...)
+	return len(b), nil
+}
+
+func (w *plainWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// hijackableWriter supports hijacking but not flushing.
+type hijackableWriter struct {
+	plainWriter
+	hijacked bool
+}
+
+func (w *hijackableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func newTestPolicy(t *testing.T, c PolicyConfig) *RetryPolicy {
+	t.Helper()
+
+	p, err := NewPolicy(c)
+	if err != nil {
+		t.Fatalf("NewPolicy(%+v): %v", c, err)
+	}
+
+	return p
+}
+
+func TestWriterInterfaces(t *testing.T) {
+	tests := []struct {
+		name     string
+		rw       http.ResponseWriter
+		flusher  bool
+		hijacker bool
+	}{
+		{name: "plain", rw: &plainWriter{header: make(http.Header)}},
+		{name: "flusher", rw: httptest.NewRecorder(), flusher: true},
+		{name: "hijacker", rw: &hijackableWriter{plainWriter: plainWriter{header: make(http.Header)}}, hijacker: true},
+		{name: "both", rw: struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{httptest.NewRecorder(), httptest.NewRecorder(), &hijackableWriter{}}, flusher: true, hijacker: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewRetryResponseWriter(tt.rw, newTestPolicy(t, PolicyConfig{}), Attempt{}).Writer()
+
+			if _, ok := w.(http.Flusher); ok != tt.flusher {
+				t.Errorf("http.Flusher = %v, want %v", ok, tt.flusher)
+			}
+
+			if _, ok := w.(http.Hijacker); ok != tt.hijacker {
+				t.Errorf("http.Hijacker = %v, want %v", ok, tt.hijacker)
+			}
+		})
+	}
+}
+
+func TestFlushNotSupported(t *testing.T) {
+	rw := &plainWriter{header: make(http.Header)}
+	w := NewRetryResponseWriter(rw, newTestPolicy(t, PolicyConfig{}), Attempt{}).Writer()
+
+	if err := http.NewResponseController(w).Flush(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Flush() = %v, want %v", err, http.ErrNotSupported)
+	}
+}
+
+func TestFlushCommits(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rrw := NewRetryResponseWriter(rec, newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2}), Attempt{})
+
+	rrw.Writer().(http.Flusher).Flush()
+
+	if !rec.Flushed || rec.Code != http.StatusOK || rrw.Retrying {
+		t.Errorf("flushed %v, status %d, retrying %v, want the 200 committed", rec.Flushed, rec.Code, rrw.Retrying)
+	}
+}
+
+func TestFlushRetrying(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rrw := NewRetryResponseWriter(rec, newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2}), Attempt{})
+	w := rrw.Writer()
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.(http.Flusher).Flush()
+
+	if rec.Flushed || !rrw.Retrying {
+		t.Errorf("flushed %v, retrying %v, want the attempt retried without flushing", rec.Flushed, rrw.Retrying)
+	}
+}
+
+// unwrapWriter exposes the writer it wraps only through Unwrap, like the writers of other middlewares.
+type unwrapWriter struct {
+	plainWriter
+	rw http.ResponseWriter
+}
+
+func (w *unwrapWriter) Unwrap() http.ResponseWriter {
+	return w.rw
+}
+
+func TestResponseControllerUnwrap(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		flushed  bool
+		hijacked bool
+	}{
+		{name: "committed", flushed: true, hijacked: true},
+		{name: "retrying", status: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			hw := &hijackableWriter{plainWriter: plainWriter{header: make(http.Header)}}
+			flushing := &unwrapWriter{plainWriter: plainWriter{header: make(http.Header)}, rw: rec}
+			hijacking := &unwrapWriter{plainWriter: plainWriter{header: make(http.Header)}, rw: hw}
+			pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2})
+
+			fw := NewRetryResponseWriter(flushing, pl, Attempt{})
+			hjw := NewRetryResponseWriter(hijacking, pl, Attempt{})
+
+			if tt.status != 0 {
+				fw.Writer().WriteHeader(tt.status)
+				hjw.Writer().WriteHeader(tt.status)
+			}
+
+			if err := http.NewResponseController(fw.Writer()).Flush(); err != nil {
+				t.Errorf("Flush() = %v", err)
+			}
+
+			if rec.Flushed != tt.flushed || fw.Retrying == tt.flushed {
+				t.Errorf("flushed %v, retrying %v, want flushed %v", rec.Flushed, fw.Retrying, tt.flushed)
+			}
+
+			if tt.flushed && flushing.status != http.StatusOK {
+				t.Errorf("status %d, want the 200 committed before flushing", flushing.status)
+			}
+
+			_, _, err := http.NewResponseController(hjw.Writer()).Hijack()
+			if hw.hijacked != tt.hijacked || (err == nil) != tt.hijacked {
+				t.Errorf("Hijack() = %v, hijacked %v, want %v", err, hw.hijacked, tt.hijacked)
+			}
+		})
+	}
+}
+
+func TestHijack(t *testing.T) {
+	rw := &hijackableWriter{plainWriter: plainWriter{header: make(http.Header)}}
+	rrw := NewRetryResponseWriter(rw, newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2}), Attempt{})
+
+	if _, _, err := rrw.Writer().(http.Hijacker).Hijack(); err != nil {
+		t.Fatalf("Hijack() = %v", err)
+	}
+
+	rrw.Finish()
+
+	if !rw.hijacked || rw.status != 0 || rrw.Retrying {
+		t.Errorf("hijacked %v, status %d, retrying %v, want the connection hijacked", rw.hijacked, rw.status, rrw.Retrying)
+	}
+}
+
+func TestHijackRetrying(t *testing.T) {
+	rw := &hijackableWriter{plainWriter: plainWriter{header: make(http.Header)}}
+	rrw := NewRetryResponseWriter(rw, newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2}), Attempt{})
+	w := rrw.Writer()
+
+	w.WriteHeader(http.StatusBadGateway)
+
+	if _, _, err := w.(http.Hijacker).Hijack(); err == nil || rw.hijacked {
+		t.Errorf("Hijack() = %v, want an error for the retried attempt", err)
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	rw := &plainWriter{header: make(http.Header)}
+	w := NewRetryResponseWriter(rw, newTestPolicy(t, PolicyConfig{}), Attempt{}).Writer()
+
+	n, err := w.(io.ReaderFrom).ReadFrom(strings.NewReader("body"))
+	if err != nil || n != 4 {
+		t.Fatalf("ReadFrom() = %d, %v", n, err)
+	}
+
+	if rw.status != http.StatusOK || string(rw.body) != "body" {
+		t.Errorf("status %d, body %q, want the implicit 200 and the body", rw.status, rw.body)
+	}
+}
+
+func TestImplicitStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    string
+		write    bool
+		retrying bool
+		status   int
+	}{
+		{name: "write committed", codes: "5xx", write: true, status: http.StatusOK},
+		{name: "write retried", codes: "200", write: true, retrying: true},
+		{name: "finish committed", codes: "5xx", status: http.StatusOK},
+		{name: "finish retried", codes: "200", retrying: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &plainWriter{header: make(http.Header)}
+			rrw := NewRetryResponseWriter(rw, newTestPolicy(t, PolicyConfig{Codes: tt.codes, Attempts: 2}), Attempt{})
+			w := rrw.Writer()
+
+			w.Header().Set("X-Upstream", "1")
+
+			if tt.write {
+				if _, err := w.Write([]byte("body")); err != nil {
+					t.Fatalf("Write() = %v", err)
+				}
+			}
+
+			rrw.Finish()
+
+			if rrw.Retrying != tt.retrying || rw.status != tt.status {
+				t.Errorf("retrying %v, status %d, want %v, %d", rrw.Retrying, rw.status, tt.retrying, tt.status)
+			}
+
+			if tt.retrying && (len(rw.body) > 0 || rw.header.Get("X-Upstream") != "") {
+				t.Errorf("the retried attempt leaked body %q, header %v", rw.body, rw.header)
+			}
+
+			if !tt.retrying && rw.header.Get("X-Upstream") != "1" {
+				t.Errorf("the committed attempt lost its header: %v", rw.header)
+			}
+		})
+	}
+}
+
+func TestGRPCHeld(t *testing.T) {
+	pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2, GRPCCodes: []string{"unavailable"}})
+
+	tests := []struct {
+		name     string
+		attempt  Attempt
+		status   string
+		flush    bool
+		flushed  bool
+		retrying bool
+	}{
+		{name: "plain HTTP", attempt: Attempt{BufferSize: 1024}, status: "14", flush: true, flushed: true},
+		{name: "gRPC ok", attempt: Attempt{BufferSize: 1024, GRPC: true}, status: "0"},
+		{name: "gRPC unavailable", attempt: Attempt{BufferSize: 1024, GRPC: true}, status: "14", retrying: true},
+		// the streamed response is committed on the first flush, before its grpc-status
+		{name: "gRPC stream", attempt: Attempt{BufferSize: 1024, GRPC: true}, status: "14", flush: true, flushed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rrw := NewRetryResponseWriter(rec, pl, tt.attempt)
+			w := rrw.Writer()
+
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("message"))
+
+			if tt.flush {
+				w.(http.Flusher).Flush()
+			}
+
+			if rec.Flushed != tt.flushed || tt.flushed && rec.Body.String() != "message" {
+				t.Errorf("flushed %v, body %q before the end of the response, want %v", rec.Flushed, rec.Body.String(), tt.flushed)
+			}
+
+			w.Header().Set("Grpc-Status", tt.status)
+			rrw.Finish()
+
+			if rrw.Retrying != tt.retrying {
+				t.Errorf("retrying %v, want %v", rrw.Retrying, tt.retrying)
+			}
+
+			if !tt.retrying && rec.Body.String() != "message" {
+				t.Errorf("body %q, want the message", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestGRPCOnly(t *testing.T) {
+	pl := newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2, GRPCCodes: []string{"unavailable"}})
+
+	tests := []struct {
+		name     string
+		status   int
+		grpc     string
+		retrying bool
+		stopped  string
+	}{
+		{name: "status", status: http.StatusServiceUnavailable, stopped: stoppedByMethod},
+		{name: "grpc-status", status: http.StatusOK, grpc: "14", retrying: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rrw := NewRetryResponseWriter(rec, pl, Attempt{BufferSize: 1024, GRPC: true, GRPCOnly: true})
+			w := rrw.Writer()
+
+			if tt.grpc != "" {
+				w.Header().Set("Grpc-Status", tt.grpc)
+			}
+
+			w.WriteHeader(tt.status)
+			rrw.Finish()
+
+			if rrw.Retrying != tt.retrying || rrw.outcome != tt.stopped && !tt.retrying {
+				t.Errorf("retrying %v, outcome %q, want %v, %q", rrw.Retrying, rrw.outcome, tt.retrying, tt.stopped)
+			}
+		})
+	}
+}
+
+func TestInformationalHeader(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("X-Middleware", "1")
+
+	rrw := NewRetryResponseWriter(rec, newTestPolicy(t, PolicyConfig{Codes: "5xx", Attempts: 2}), Attempt{})
+	w := rrw.Writer()
+
+	w.Header().Set("Link", "</style.css>; rel=preload")
+	w.Header().Set("X-Middleware", "2")
+	w.WriteHeader(http.StatusEarlyHints)
+
+	w.Header().Set("Set-Cookie", "session=1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	rrw.Finish()
+
+	if !rrw.Retrying {
+		t.Fatal("the attempt isn't retried")
+	}
+
+	for _, k := range []string{"Link", "Set-Cookie"} {
+		if v := rec.Header().Get(k); v != "" {
+			t.Errorf("the retried attempt leaked %s: %s", k, v)
+		}
+	}
+
+	if v := rec.Header().Get("X-Middleware"); v != "1" {
+		t.Errorf("X-Middleware = %q, want the header set before the attempt", v)
+	}
+}
@@ -0,0 +1,144 @@
+package traefikretryplugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var ErrQuotaExceeded = errors.New("disk quota exceeded")
+
+// DiskQuota accounts the bytes spilled to disk by the requests served concurrently.
+type DiskQuota struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// NewDiskQuota creates a quota of the given number of bytes, zero means no limit.
+func NewDiskQuota(limit int64) *DiskQuota {
+	return &DiskQuota{limit: limit}
+}
+
+// acquire reserves up to n bytes and returns the reserved amount.
+func (q *DiskQuota) acquire(n int64) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.limit > 0 && q.used+n > q.limit {
+		n = q.limit - q.used
+	}
+
+	if n < 0 {
+		n = 0
+	}
+
+	q.used += n
+
+	return n
+}
+
+func (q *DiskQuota) release(n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.used -= n
+}
+
+// SpillFile is a temporary file holding a request body that doesn't fit in memory.
+// Close removes the file and returns its size to the quota.
+type SpillFile struct {
+	f     *os.File
+	quota *DiskQuota
+	size  int64
+}
+
+func NewSpillFile(dir string, quota *DiskQuota) (*SpillFile, error) {
+	f, err := os.CreateTemp(dir, "traefikretryplugin-*")
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.NewSpillFile: can't create file: %w", err)
+	}
+
+	return &SpillFile{
+		f:     f,
+		quota: quota,
+	}, nil
+}
+
+const spillChunkSize = 32 * 1024
+
+// ReadFrom copies the reader into the file. Space is reserved in the quota before every read,
+// so nothing is read from the reader once the quota is exceeded.
+func (s *SpillFile) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, spillChunkSize)
+
+	var total int64
+
+	for {
+		reserved := s.quota.acquire(spillChunkSize)
+		if reserved == 0 {
+			return total, fmt.Errorf("traefikretryplugin.SpillFile.ReadFrom: %w", ErrQuotaExceeded)
+		}
+
+		n, err := r.Read(buf[:reserved])
+
+		wn, werr := s.f.Write(buf[:n])
+		s.size += int64(wn)
+		total += int64(wn)
+
+		s.quota.release(reserved - int64(wn))
+
+		if werr != nil {
+			return total, fmt.Errorf("traefikretryplugin.SpillFile.ReadFrom: can't write: %w", werr)
+		}
+
+		switch {
+		case err == io.EOF:
+			return total, nil
+		case err != nil:
+			return total, fmt.Errorf("traefikretryplugin.SpillFile.ReadFrom: can't read: %w", err)
+		}
+	}
+}
+
+func (s *SpillFile) Size() int64 {
+	return s.size
+}
+
+func (s *SpillFile) Read(p []byte) (int, error) {
+	return s.f.Read(p)
+}
+
+func (s *SpillFile) ReadAt(p []byte, off int64) (int, error) {
+	return s.f.ReadAt(p, off)
+}
+
+func (s *SpillFile) Seek(offset int64, whence int) (int64, error) {
+	return s.f.Seek(offset, whence)
+}
+
+func (s *SpillFile) Close() error {
+	errClose := s.f.Close()
+	errRemove := os.Remove(s.f.Name())
+
+	s.quota.release(s.size)
+	s.size = 0
+
+	if errClose != nil {
+		return fmt.Errorf("traefikretryplugin.SpillFile.Close: %w", errClose)
+	}
+
+	if errRemove != nil {
+		return fmt.Errorf("traefikretryplugin.SpillFile.Close: %w", errRemove)
+	}
+
+	return nil
+}
+
+var (
+	_ io.ReadSeekCloser = (*SpillFile)(nil)
+	_ io.ReaderFrom     = (*SpillFile)(nil)
+	_ io.ReaderAt       = (*SpillFile)(nil)
+)
@@ -0,0 +1,348 @@
+package traefikretryplugin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanContext is the W3C trace context of a span.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+const flagSampled = 0x01
+
+// ParseTraceparent reads the traceparent header, later versions are read as far as version 00 goes.
+func ParseTraceparent(v string) (SpanContext, bool) {
+	var sc SpanContext
+
+	v = strings.TrimSpace(v)
+
+	if len(v) < 55 || len(v) > 55 && (v[:2] == "00" || v[55] != '-') ||
+		v[2] != '-' || v[35] != '-' || v[52] != '-' || v[:2] == "ff" {
+		return sc, false
+	}
+
+	var version, flags [1]byte
+
+	if !decodeHex(version[:], v[:2]) || !decodeHex(sc.TraceID[:], v[3:35]) || !decodeHex(sc.SpanID[:], v[36:52]) {
+		return sc, false
+	}
+
+	if !decodeHex(flags[:], v[53:55]) {
+		return sc, false
+	}
+
+	sc.Flags = flags[0]
+
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+
+	return sc, true
+}
+
+// decodeHex accepts lowercase hex only, as the trace context requires.
+func decodeHex(dst []byte, s string) bool {
+	if strings.ToLower(s) != s {
+		return false
+	}
+
+	_, err := hex.Decode(dst, []byte(s))
+
+	return err == nil
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// String formats the context as the version 00 traceparent header.
+func (sc SpanContext) String() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" +
+		hex.EncodeToString([]byte{sc.Flags})
+}
+
+// Span is an attempt traced as a client span. A nil span records nothing.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	context  SpanContext
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    []otlpAttribute
+	failed   bool
+}
+
+// Context is the span context to propagate to the upstream.
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+func (s *Span) SetInt(key string, v int) {
+	if s == nil {
+		return
+	}
+
+	s.attrs = append(s.attrs, otlpAttribute{Key: key, Value: otlpValue{IntValue: strconv.Itoa(v)}})
+}
+
+func (s *Span) SetString(key, v string) {
+	if s == nil {
+		return
+	}
+
+	s.attrs = append(s.attrs, otlpAttribute{Key: key, Value: otlpValue{StringValue: &v}})
+}
+
+// SetFailed marks the span with the error status.
+func (s *Span) SetFailed() {
+	if s == nil {
+		return
+	}
+
+	s.failed = true
+}
+
+// End exports the span when it's sampled, the span is dropped when the export queue is full.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+
+	if !s.context.Sampled() {
+		return
+	}
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+	}
+}
+
+const (
+	exportInterval  = 5 * time.Second
+	exportBatchSize = 512
+	exportQueueSize = 2048
+)
+
+// Tracer exports spans in batches over OTLP/HTTP with the JSON encoding. A nil tracer traces nothing.
+type Tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	spans    chan *Span
+	log      *Logger
+}
+
+var (
+	tracersMu sync.Mutex
+	tracers   = make(map[string]*Tracer)
+)
+
+// NewTracer returns the tracer exporting to the endpoint, eg: http://collector:4318/v1/traces.
+// The tracers are shared by the plugin instances, so that a reloaded configuration doesn't start another exporter.
+func NewTracer(endpoint, service string, log *Logger) *Tracer {
+	tracersMu.Lock()
+	defer tracersMu.Unlock()
+
+	key := endpoint + " " + service
+
+	if t, ok := tracers[key]; ok {
+		return t
+	}
+
+	t := &Tracer{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *Span, exportQueueSize),
+		log:      log,
+	}
+
+	tracers[key] = t
+
+	go t.run()
+
+	return t
+}
+
+// NewTraceContext is the parent of the root spans of a new sampled trace.
+func NewTraceContext() SpanContext {
+	sc := SpanContext{Flags: flagSampled}
+
+	_, _ = rand.Read(sc.TraceID[:])
+
+	return sc
+}
+
+// Start starts a child span of the parent.
+func (t *Tracer) Start(parent SpanContext, name string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{
+		tracer:   t,
+		name:     name,
+		context:  SpanContext{TraceID: parent.TraceID, Flags: parent.Flags},
+		parentID: parent.SpanID,
+		start:    time.Now(),
+	}
+
+	_, _ = rand.Read(s.context.SpanID[:])
+
+	return s
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exportBatchSize)
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+
+			if len(batch) < exportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := t.export(batch); err != nil {
+			t.log.Warn("can't export spans", "spans", len(batch), "error", err)
+		}
+
+		batch = batch[:0]
+	}
+}
+
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+
+	for _, s := range batch {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindClient,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+		}
+
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+
+		if s.failed {
+			span.Status.Code = otlpStatusError
+		}
+
+		spans = append(spans, span)
+	}
+
+	service := t.service
+
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: &service}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "traefikretryplugin"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return fmt.Errorf("traefikretryplugin.export: %w", err)
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("traefikretryplugin.export: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("traefikretryplugin.export: collector answered %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+const (
+	otlpSpanKindClient = 3
+	otlpStatusError    = 2
+)
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue holds either value, the integers are encoded as strings like the int64 of protobuf JSON.
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
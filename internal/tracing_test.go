@@ -0,0 +1,152 @@
+package traefikretryplugin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       string
+		ok      bool
+		sampled bool
+	}{
+		{name: "sampled", v: "00-" + testTraceID + "-" + testSpanID + "-01", ok: true, sampled: true},
+		{name: "unsampled", v: "00-" + testTraceID + "-" + testSpanID + "-00", ok: true},
+		{name: "spaces", v: " 00-" + testTraceID + "-" + testSpanID + "-01 ", ok: true, sampled: true},
+		{name: "future version", v: "01-" + testTraceID + "-" + testSpanID + "-01", ok: true, sampled: true},
+		{name: "future version with fields", v: "cc-" + testTraceID + "-" + testSpanID + "-01-what-the-future", ok: true, sampled: true},
+		{name: "future version without separator", v: "cc-" + testTraceID + "-" + testSpanID + "-01what"},
+		{name: "version 00 with fields", v: "00-" + testTraceID + "-" + testSpanID + "-01-extra"},
+		{name: "version ff", v: "ff-" + testTraceID + "-" + testSpanID + "-01"},
+		{name: "uppercase", v: "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + testSpanID + "-01"},
+		{name: "zero trace id", v: "00-00000000000000000000000000000000-" + testSpanID + "-01"},
+		{name: "zero span id", v: "00-" + testTraceID + "-0000000000000000-01"},
+		{name: "bad separator", v: "00_" + testTraceID + "-" + testSpanID + "-01"},
+		{name: "bad flags", v: "00-" + testTraceID + "-" + testSpanID + "-0x"},
+		{name: "short", v: "00-" + testTraceID + "-" + testSpanID},
+		{name: "empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.v)
+			if ok != tt.ok {
+				t.Fatalf("ParseTraceparent(%q) = %v, want %v", tt.v, ok, tt.ok)
+			}
+
+			if !ok {
+				return
+			}
+
+			if hex.EncodeToString(sc.TraceID[:]) != testTraceID || hex.EncodeToString(sc.SpanID[:]) != testSpanID {
+				t.Errorf("ParseTraceparent(%q) = %s", tt.v, sc)
+			}
+
+			if sc.Sampled() != tt.sampled {
+				t.Errorf("Sampled() = %v, want %v", sc.Sampled(), tt.sampled)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	v := "00-" + testTraceID + "-" + testSpanID + "-01"
+
+	sc, ok := ParseTraceparent(v)
+	if !ok || sc.String() != v {
+		t.Errorf("String() = %s, want %s", sc, v)
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	var (
+		contentType string
+		traces      otlpTraces
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		contentType = req.Header.Get("Content-Type")
+
+		body, _ := io.ReadAll(req.Body)
+		if err := json.Unmarshal(body, &traces); err != nil {
+			t.Errorf("can't decode %s: %v", body, err)
+		}
+	}))
+	defer srv.Close()
+
+	tr := &Tracer{endpoint: srv.URL, service: "edge", client: srv.Client(), spans: make(chan *Span, 2)}
+
+	parent, _ := ParseTraceparent("00-" + testTraceID + "-" + testSpanID + "-01")
+
+	first := tr.Start(parent, "attempt")
+	first.SetInt("retry.attempt", 0)
+	first.SetString("retry.reason", "status")
+	first.SetFailed()
+	first.End()
+
+	second := tr.Start(parent, "attempt")
+	second.SetInt("retry.attempt", 1)
+	second.End()
+
+	// the unsampled spans aren't queued
+	tr.Start(SpanContext{TraceID: parent.TraceID, SpanID: parent.SpanID}, "attempt").End()
+
+	if len(tr.spans) != 2 {
+		t.Fatalf("%d spans queued, want 2", len(tr.spans))
+	}
+
+	if err := tr.export([]*Span{<-tr.spans, <-tr.spans}); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "application/json" {
+		t.Errorf("Content-Type = %s", contentType)
+	}
+
+	if len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected export %+v", traces)
+	}
+
+	rs := traces.ResourceSpans[0]
+	if a := rs.Resource.Attributes; len(a) != 1 || a[0].Key != "service.name" || *a[0].Value.StringValue != "edge" {
+		t.Errorf("resource attributes %+v", a)
+	}
+
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("%d spans exported, want 2", len(spans))
+	}
+
+	for i, s := range spans {
+		if s.TraceID != testTraceID || s.ParentSpanID != testSpanID || s.SpanID == testSpanID || len(s.SpanID) != 16 {
+			t.Errorf("span %d: trace %s, parent %s, span %s, want a child of the parent", i, s.TraceID, s.ParentSpanID, s.SpanID)
+		}
+
+		if s.Kind != otlpSpanKindClient || s.StartTimeUnixNano == "" || s.EndTimeUnixNano == "" {
+			t.Errorf("span %d: %+v", i, s)
+		}
+
+		if a := s.Attributes[0]; a.Key != "retry.attempt" || a.Value.IntValue != []string{"0", "1"}[i] {
+			t.Errorf("span %d: attribute %+v", i, a)
+		}
+	}
+
+	if spans[0].SpanID == spans[1].SpanID {
+		t.Errorf("the attempts share the span id %s", spans[0].SpanID)
+	}
+
+	if spans[0].Status.Code != otlpStatusError || spans[1].Status.Code != 0 {
+		t.Errorf("statuses %d, %d, want the failed attempt only with the error status", spans[0].Status.Code, spans[1].Status.Code)
+	}
+}
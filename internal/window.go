@@ -0,0 +1,60 @@
+package traefikretryplugin
+
+import (
+	"time"
+)
+
+type windowBucket struct {
+	second int64
+	counts [2]int
+}
+
+// window keeps a pair of counters over the last seconds.
+type window struct {
+	buckets []windowBucket
+}
+
+func newWindow(d time.Duration) window {
+	seconds := int(d / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return window{buckets: make([]windowBucket, seconds)}
+}
+
+func (w *window) seconds() int {
+	return len(w.buckets)
+}
+
+func (w *window) add(now time.Time, i int) {
+	sec := now.Unix()
+
+	bk := &w.buckets[sec%int64(len(w.buckets))]
+	if bk.second != sec {
+		*bk = windowBucket{second: sec}
+	}
+
+	bk.counts[i]++
+}
+
+func (w *window) sums(now time.Time) (int, int) {
+	sec := now.Unix()
+
+	var a, b int
+
+	for _, bk := range w.buckets {
+		if sec-bk.second < int64(len(w.buckets)) {
+			a += bk.counts[0]
+			b += bk.counts[1]
+		}
+	}
+
+	return a, b
+}
+
+func (w *window) reset() {
+	for i := range w.buckets {
+		w.buckets[i] = windowBucket{}
+	}
+}
@@ -3,21 +3,134 @@ package traefikretryplugin
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	. "github.com/atidev/golib/pkg/structuredheaders"
 	. "github.com/atidev/traefikretryplugin/internal"
 	"io"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
+	"time"
 )
 
+// Config holds the default policy applied to requests without the Retry-Policy header.
+// The header, when present, overrides the fields it specifies.
 type Config struct {
+	Codes    string `json:"codes,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	Backoff  string `json:"backoff,omitempty"`
+	Jitter   string `json:"jitter,omitempty"`
+	// Methods lists the methods allowed to be retried, the idempotent ones by default.
+	Methods []string `json:"methods,omitempty"`
+	// On lists the transport failures to retry: connect-failure, reset, timeout.
+	On []string `json:"on,omitempty"`
+	// Headers lists the response headers making an attempt retryable, eg: "X-Retryable: ?1".
+	Headers []string `json:"headers,omitempty"`
+	// GrpcCodes lists the gRPC status codes to retry, eg: UNAVAILABLE, and enables the gRPC mode.
+	GrpcCodes []string `json:"grpcCodes,omitempty"`
+
+	MaxRetryAfter string `json:"maxRetryAfter,omitempty"`
+	PerTryTimeout string `json:"perTryTimeout,omitempty"`
+	Deadline      string `json:"deadline,omitempty"`
+
+	// Mode is either "sequential" (default) or "hedge" to run attempts in parallel.
+	Mode       string `json:"mode,omitempty"`
+	HedgeDelay string `json:"hedgeDelay,omitempty"`
+	// Parallel limits the hedged attempts running at once.
+	Parallel int `json:"parallel,omitempty"`
+
+	// MaxAttempts and MaxParallel cap the attempts and parallel asked for by the Retry-Policy header,
+	// 10 and 5 by default.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	MaxParallel int `json:"maxParallel,omitempty"`
+
+	// BudgetPercent limits the retries to the percent of the requests within BudgetWindow, 10s by default.
+	// BudgetMinRetriesPerSecond allows some retries regardless of the number of requests.
+	// The budget is disabled when both are zero.
+	BudgetPercent             float64 `json:"budgetPercent,omitempty"`
+	BudgetMinRetriesPerSecond int     `json:"budgetMinRetriesPerSecond,omitempty"`
+	BudgetWindow              string  `json:"budgetWindow,omitempty"`
+
+	// BreakerFailureRatio of the attempts within BreakerWindow opens the circuit breaker, which is disabled when zero.
+	// The breaker needs BreakerMinAttempts, 20 by default, to open. It stays open for BreakerOpenDuration, 30s by default,
+	// then lets BreakerProbes attempts, 1 by default, through to decide whether to close.
+	// BreakerMode is either "disable-retries" (default) or "fail-fast" to reject the requests with 503 while the breaker is open.
+	BreakerFailureRatio float64 `json:"breakerFailureRatio,omitempty"`
+	BreakerMinAttempts  int     `json:"breakerMinAttempts,omitempty"`
+	BreakerWindow       string  `json:"breakerWindow,omitempty"`
+	BreakerOpenDuration string  `json:"breakerOpenDuration,omitempty"`
+	BreakerProbes       int     `json:"breakerProbes,omitempty"`
+	BreakerMode         string  `json:"breakerMode,omitempty"`
+
+	// LogLevel is one of "debug", "info" (default), "warn", "error".
+	LogLevel string `json:"logLevel,omitempty"`
+	// LogFormat is either "logfmt" (default) or "json".
+	LogFormat string `json:"logFormat,omitempty"`
+
+	// MetricsPath serves the metrics of the plugin instances in Prometheus text format
+	// on the routers using the middleware, MetricsAddress serves them on a listener of their own at /metrics.
+	// The metrics are collected only when either is set. MetricsPath is answered to any client of the routers
+	// ahead of the upstream, so the routers have to restrict it.
+	MetricsPath    string `json:"metricsPath,omitempty"`
+	MetricsAddress string `json:"metricsAddress,omitempty"`
+
+	// TracingEndpoint is the OTLP/HTTP collector receiving a span per attempt, eg: http://collector:4318/v1/traces.
+	// Tracing is disabled when empty. TracingServiceName names the service of the spans, "traefik" by default.
+	TracingEndpoint    string `json:"tracingEndpoint,omitempty"`
+	TracingServiceName string `json:"tracingServiceName,omitempty"`
+
+	// RetryInfo annotates the responses with the Retry-Info header describing the retries.
+	// It's meant for internal clients, the header reveals the failures of the upstream.
+	RetryInfo bool `json:"retryInfo,omitempty"`
+
+	// ResponseContains, ResponseRegex and ResponseJSON make the attempts with a matching response body retryable,
+	// whatever their status. ResponseJSON compares the value at a JSON pointer, eg: /errors/0/code == "UNAVAILABLE".
+	// The body is inspected up to ResponseBufferSize bytes, 64KiB by default, larger responses are committed as is.
+	ResponseContains   string `json:"responseContains,omitempty"`
+	ResponseRegex      string `json:"responseRegex,omitempty"`
+	ResponseJSON       string `json:"responseJSON,omitempty"`
+	ResponseBufferSize int64  `json:"responseBufferSize,omitempty"`
+
+	// MaxBodySize limits the request body buffered for retries, zero means no limit.
+	MaxBodySize int64 `json:"maxBodySize,omitempty"`
+	// BodyLimitMode is either "bypass" to stream larger bodies without retries, or "reject" to answer 413.
+	BodyLimitMode string `json:"bodyLimitMode,omitempty"`
+	// MemoryBodySize is the part of the body kept in memory, the rest is spilled to a file in TempDir.
+	// Zero keeps the whole body in memory.
+	MemoryBodySize int64  `json:"memoryBodySize,omitempty"`
+	TempDir        string `json:"tempDir,omitempty"`
+	// DiskQuota limits the bytes spilled to disk by all requests in flight, zero means no limit.
+	DiskQuota int64 `json:"diskQuota,omitempty"`
 }
 
+const (
+	bodyLimitModeBypass = "bypass"
+	bodyLimitModeReject = "reject"
+)
+
 type retryPlugin struct {
-	next http.Handler
-	name string
-	ctx  context.Context
+	next    http.Handler
+	name    string
+	ctx     context.Context
+	policy  *RetryPolicy
+	budget  *RetryBudget
+	breaker *CircuitBreaker
+	log     *Logger
+	metrics *Metrics
+	tracer  *Tracer
+
+	metricsPath   string
+	retryInfo     bool
+	bodyPredicate *BodyPredicate
+	bufferSize    int64
+
+	maxBodySize     int64
+	rejectLargeBody bool
+	memoryBodySize  int64
+	tempDir         string
+	diskQuota       *DiskQuota
 }
 
 //goland:noinspection GoUnusedExportedFunction
@@ -26,73 +139,597 @@ func CreateConfig() *Config {
 }
 
 //goland:noinspection GoUnusedExportedFunction
-func New(_ context.Context, next http.Handler, _ *Config, name string) (http.Handler, error) {
+func New(_ context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	if config == nil {
+		config = CreateConfig()
+	}
+
+	pl, err := defaultPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.New: invalid config of %s: %w", name, err)
+	}
+
+	if config.MaxBodySize < 0 || config.MemoryBodySize < 0 || config.DiskQuota < 0 {
+		return nil, fmt.Errorf("traefikretryplugin.New: invalid config of %s: negative body size", name)
+	}
+
+	budget, err := retryBudget(config)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.New: invalid config of %s: %w", name, err)
+	}
+
+	breaker, err := circuitBreaker(config)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.New: invalid config of %s: %w", name, err)
+	}
+
+	log, err := logger(config, name)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.New: invalid config of %s: %w", name, err)
+	}
+
+	switch config.BodyLimitMode {
+	case "", bodyLimitModeBypass, bodyLimitModeReject:
+	default:
+		return nil, fmt.Errorf("traefikretryplugin.New: invalid config of %s: unknown body limit mode `%s`", name, config.BodyLimitMode)
+	}
+
+	var metrics *Metrics
+
+	if config.MetricsPath != "" || config.MetricsAddress != "" {
+		metrics = NewMetrics(name)
+		DefaultRegistry.Register(metrics)
+	}
+
+	if config.MetricsAddress != "" {
+		if err = DefaultRegistry.Listen(config.MetricsAddress); err != nil {
+			log.Error("can't serve metrics", "address", config.MetricsAddress, "error", err)
+		}
+	}
+
+	bodyPredicate, err := responsePredicate(config)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.New: invalid config of %s: %w", name, err)
+	}
+
+	bufferSize := config.ResponseBufferSize
+	if bufferSize == 0 {
+		bufferSize = defaultResponseBufferSize
+	}
+
+	if bufferSize < 0 {
+		return nil, fmt.Errorf("traefikretryplugin.New: invalid config of %s: negative response buffer size", name)
+	}
+
+	var tracer *Tracer
+
+	if config.TracingEndpoint != "" {
+		service := config.TracingServiceName
+		if service == "" {
+			service = defaultTracingServiceName
+		}
+
+		tracer = NewTracer(config.TracingEndpoint, service, log)
+	}
+
 	return &retryPlugin{
-		next: next,
-		name: name,
+		next:    next,
+		name:    name,
+		policy:  pl,
+		budget:  budget,
+		breaker: breaker,
+		log:     log,
+		metrics: metrics,
+		tracer:  tracer,
+
+		metricsPath:   config.MetricsPath,
+		retryInfo:     config.RetryInfo,
+		bodyPredicate: bodyPredicate,
+		bufferSize:    bufferSize,
+
+		maxBodySize:     config.MaxBodySize,
+		rejectLargeBody: config.BodyLimitMode == bodyLimitModeReject,
+		memoryBodySize:  config.MemoryBodySize,
+		tempDir:         config.TempDir,
+		diskQuota:       NewDiskQuota(config.DiskQuota),
 	}, nil
 }
 
-var bbPool = sync.Pool{New: func() interface{} { return make([]byte, 0, 512) }}
+func defaultPolicy(config *Config) (*RetryPolicy, error) {
+	if config.Codes == "" && config.Attempts == 0 {
+		return nil, nil
+	}
+
+	return NewPolicy(PolicyConfig{
+		Codes:    config.Codes,
+		Attempts: config.Attempts,
+		Backoff:  config.Backoff,
+		Jitter:   config.Jitter,
+		Methods:  config.Methods,
+		On:       config.On,
+		Headers:  config.Headers,
+
+		GRPCCodes: config.GrpcCodes,
+
+		MaxRetryAfter: config.MaxRetryAfter,
+		PerTryTimeout: config.PerTryTimeout,
+		Deadline:      config.Deadline,
+
+		Mode:       config.Mode,
+		HedgeDelay: config.HedgeDelay,
+		Parallel:   config.Parallel,
+
+		MaxAttempts: config.MaxAttempts,
+		MaxParallel: config.MaxParallel,
+	})
+}
+
+const (
+	defaultTracingServiceName = "traefik"
+	defaultResponseBufferSize = 64 * 1024
+)
+
+// maxPooledBufferSize keeps buffers grown by large bodies out of the pool.
+const maxPooledBufferSize = 64 * 1024
+
+func logger(config *Config, name string) (*Logger, error) {
+	level, err := ParseLevel(config.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.logger: %w", err)
+	}
+
+	format, err := ParseLogFormat(config.LogFormat)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.logger: %w", err)
+	}
+
+	return NewLogger(os.Stdout, level, format).With("router", name), nil
+}
+
+func responsePredicate(config *Config) (*BodyPredicate, error) {
+	if config.ResponseContains == "" && config.ResponseRegex == "" && config.ResponseJSON == "" {
+		return nil, nil
+	}
+
+	bp, err := NewBodyPredicate(config.ResponseContains, config.ResponseRegex, config.ResponseJSON)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.responsePredicate: %w", err)
+	}
+
+	return bp, nil
+}
+
+func retryBudget(config *Config) (*RetryBudget, error) {
+	if config.BudgetPercent == 0 && config.BudgetMinRetriesPerSecond == 0 {
+		return nil, nil
+	}
+
+	if config.BudgetPercent < 0 || config.BudgetMinRetriesPerSecond < 0 {
+		return nil, errors.New("traefikretryplugin.retryBudget: negative budget")
+	}
+
+	var window time.Duration
+
+	if config.BudgetWindow != "" {
+		var err error
+
+		window, err = time.ParseDuration(config.BudgetWindow)
+		if err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.retryBudget: can't parse window: %w", err)
+		}
+	}
+
+	return NewRetryBudget(config.BudgetPercent, config.BudgetMinRetriesPerSecond, window), nil
+}
+
+const (
+	defaultBreakerMinAttempts  = 20
+	defaultBreakerWindow       = 10 * time.Second
+	defaultBreakerOpenDuration = 30 * time.Second
+	defaultBreakerProbes       = 1
+)
+
+func circuitBreaker(config *Config) (*CircuitBreaker, error) {
+	if config.BreakerFailureRatio == 0 {
+		return nil, nil
+	}
+
+	if config.BreakerFailureRatio < 0 || config.BreakerFailureRatio > 1 {
+		return nil, fmt.Errorf("traefikretryplugin.circuitBreaker: failure ratio out of [0 1]: %g", config.BreakerFailureRatio)
+	}
+
+	mode, err := ParseBreakerMode(config.BreakerMode)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.circuitBreaker: %w", err)
+	}
+
+	bc := BreakerConfig{
+		Mode:         mode,
+		FailureRatio: config.BreakerFailureRatio,
+		MinAttempts:  config.BreakerMinAttempts,
+		Window:       defaultBreakerWindow,
+		OpenDuration: defaultBreakerOpenDuration,
+		Probes:       config.BreakerProbes,
+	}
+
+	if bc.MinAttempts == 0 {
+		bc.MinAttempts = defaultBreakerMinAttempts
+	}
+
+	if bc.Probes == 0 {
+		bc.Probes = defaultBreakerProbes
+	}
+
+	if bc.MinAttempts < 0 || bc.Probes < 0 {
+		return nil, errors.New("traefikretryplugin.circuitBreaker: negative min attempts or probes")
+	}
+
+	if config.BreakerWindow != "" {
+		if bc.Window, err = time.ParseDuration(config.BreakerWindow); err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.circuitBreaker: can't parse window: %w", err)
+		}
+	}
+
+	if config.BreakerOpenDuration != "" {
+		if bc.OpenDuration, err = time.ParseDuration(config.BreakerOpenDuration); err != nil {
+			return nil, fmt.Errorf("traefikretryplugin.circuitBreaker: can't parse open duration: %w", err)
+		}
+	}
+
+	return NewCircuitBreaker(bc), nil
+}
+
+var bbPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func getBuffer() *bytes.Buffer {
+	return bbPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(bb *bytes.Buffer) {
+	if bb.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	bb.Reset()
+	bbPool.Put(bb)
+}
 
 func (p *retryPlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if bypass(req.Header) {
+	if p.metricsPath != "" && req.URL.Path == p.metricsPath {
+		DefaultRegistry.ServeHTTP(rw, req)
+		return
+	}
+
+	if p.bypass(req.Header) {
+		p.next.ServeHTTP(rw, req)
+		return
+	}
+
+	pl := p.policyFrom(req)
+	if pl == nil {
 		p.next.ServeHTTP(rw, req)
 		return
 	}
 
-	bb := bbPool.Get().([]byte)
-	defer func() {
-		bb = bb[:0]
-		bbPool.Put(bb)
-	}()
+	// gRPC calls are POST requests, those the methods exclude are retried by their grpc-status only
+	grpc := pl.GRPC() && IsGRPC(req)
+	methodAllowed := pl.AllowsMethod(req.Method, req.Header.Get("Idempotency-Key") != "")
+
+	if !methodAllowed && !grpc {
+		p.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if p.maxBodySize > 0 && req.ContentLength > p.maxBodySize {
+		p.serveLargeBody(rw, req, nil)
+		return
+	}
+
+	bb := getBuffer()
+	defer putBuffer(bb)
+
+	rdr, err := p.readBody(bb, req)
+	if c, ok := rdr.(io.Closer); ok {
+		defer func() {
+			if err := c.Close(); err != nil {
+				p.log.Warn("can't release request body", "error", err)
+			}
+		}()
+	}
+
+	if errors.Is(err, errBodyTooLarge) {
+		p.serveLargeBody(rw, req, rdr)
+		return
+	}
 
-	rdr, err := bufferBody(bb, req)
 	if err != nil {
-		fmt.Printf("ServeHTTP: %s\n", err)
+		p.log.Error("can't read request body", "error", err)
 
 		internalServerError(rw)
 		return
 	}
 
-	pl := policyFrom(req)
+	if err = fixContentLength(req, rdr); err != nil {
+		p.log.Error("can't read request body", "error", err)
 
-	fmt.Printf("ServeHTTP: %s\n", pl.String())
+		internalServerError(rw)
+		return
+	}
 
-	var rrw *RetryResponseWriter
+	// the probe let through by the half-open breaker is given back when no attempt accounts it
+	if !p.breaker.Allow() {
+		serviceUnavailable(rw)
+		return
+	}
+
+	if p.log.Enabled(LevelDebug) {
+		p.log.Debug("retrying request", "method", req.Method, "path", req.URL.Path, "policy", pl.String())
+	}
+
+	var (
+		rrw      *RetryResponseWriter
+		delay    time.Duration
+		deadline time.Time
+	)
+
+	if d := pl.Deadline(); d > 0 {
+		deadline = time.Now().Add(d)
+	}
+
+	grpcTimeout := p.grpcDeadline(req, pl, &deadline)
+
+	p.budget.Request()
+	p.metrics.Request(req.ContentLength)
+
+	parent := p.traceContext(req)
+
+	var info *RetryInfo
+	if p.retryInfo {
+		info = &RetryInfo{}
+	}
+
+	if ra, ok := rdr.(io.ReaderAt); ok && pl.Hedged() {
+		p.serveHedged(rw, req, pl, Attempt{Deadline: deadline, Budget: p.budget, Breaker: p.breaker, Info: info}, ra, parent)
+		return
+	}
 
 	for attempt := 0; rrw == nil || rrw.Retrying; attempt++ {
+		if rrw != nil {
+			delay = rrw.Delay
+
+			p.metrics.Retry(rrw.Status())
+			p.metrics.Wait(delay)
+			info.Retried(rrw.Status(), delay)
+
+			if err = wait(req.Context(), delay); err != nil {
+				p.log.Info("request cancelled while waiting to retry", "attempt", attempt, "error", err)
+				return
+			}
+		}
+
+		if grpcTimeout {
+			req.Header.Set("Grpc-Timeout", FormatGRPCTimeout(time.Until(deadline)))
+		}
+
 		if err = copyBody(rw, req, rdr); err != nil {
-			fmt.Printf("ServeHTTP: %s\n", err)
+			p.log.Error("can't replay request body", "attempt", attempt, "error", err)
+
+			if rrw == nil {
+				p.breaker.Release()
+			}
 
 			internalServerError(rw)
 			return
 		}
 
-		rrw = NewRetryResponseWriter(rw, pl, attempt)
+		a := Attempt{
+			Number:     attempt,
+			PrevDelay:  delay,
+			Deadline:   deadline,
+			Budget:     p.budget,
+			Breaker:    p.breaker,
+			Info:       info,
+			Body:       p.bodyPredicate,
+			BufferSize: p.bufferSize,
+			GRPC:       grpc,
+			GRPCOnly:   !methodAllowed,
+		}
+
+		areq, cancel := attemptRequest(req, pl, &a)
+
+		rrw = NewRetryResponseWriter(rw, pl, a)
+
+		span := p.startSpan(areq, parent, attempt)
+
+		p.next.ServeHTTP(rrw.Writer(), areq)
+
+		rrw.Finish()
+		cancel()
+
+		endSpan(span, rrw.Status(), rrw.Failed(), rrw.Retrying, rrw.Reason(), rrw.Stopped())
+
+		p.logAttempt(pl, rrw, attempt)
+	}
+
+	p.metrics.Done(rrw.Attempt()+1, rrw.Failed())
+}
+
+// serveHedged runs the attempts in parallel, each of them reads the body on its own.
+func (p *retryPlugin) serveHedged(rw http.ResponseWriter, req *http.Request, pl *RetryPolicy, base Attempt, body io.ReaderAt,
+	parent SpanContext,
+) {
+	h := NewHedge(rw, pl, base)
+
+	h.Run(req.Context(), func(ctx context.Context, w *HedgeResponseWriter) {
+		areq := req.Clone(ctx)
+		areq.Body = io.NopCloser(io.NewSectionReader(body, 0, req.ContentLength))
+
+		span := p.startSpan(areq, parent, w.Attempt())
+
+		p.next.ServeHTTP(w, areq)
+
+		reason := ""
+		if !w.Committed() {
+			reason = hedgeReason(w.Reason())
+		}
+
+		endSpan(span, w.Status(), w.Failed(), !w.Committed(), reason, "")
+	})
 
-		p.next.ServeHTTP(rrw, req)
+	for _, status := range h.Discarded() {
+		p.metrics.Retry(status)
 	}
+
+	p.metrics.Done(h.Attempts(), h.Failed())
 }
 
-func policyFrom(req *http.Request) *RetryPolicy {
-	ph, err := NewStructuredHeader(req.Header).Dictionary("Retry-Policy")
+// grpcDeadline bounds the retries of a gRPC call by its grpc-timeout, and tells whether the call has one.
+// The timeout sent to the upstream is then reduced to the time left before each attempt.
+func (p *retryPlugin) grpcDeadline(req *http.Request, pl *RetryPolicy, deadline *time.Time) bool {
+	v := req.Header.Get("Grpc-Timeout")
+	if v == "" || !pl.GRPC() || !IsGRPC(req) {
+		return false
+	}
+
+	t, err := ParseGRPCTimeout(v)
 	if err != nil {
-		fmt.Printf("traefikretryplugin.policyFrom: error reading policy header as dictionary: %s\n", err)
+		p.log.Warn("can't parse grpc timeout", "error", err)
+		return false
+	}
+
+	if d := time.Now().Add(t); deadline.IsZero() || d.Before(*deadline) {
+		*deadline = d
+	}
+
+	return true
+}
+
+// traceContext is the trace context of the request, or a new trace when the request has none.
+func (p *retryPlugin) traceContext(req *http.Request) SpanContext {
+	if p.tracer == nil {
+		return SpanContext{}
+	}
+
+	if sc, ok := ParseTraceparent(req.Header.Get("Traceparent")); ok {
+		return sc
+	}
+
+	return NewTraceContext()
+}
+
+// startSpan traces the attempt as a child of the parent and propagates the span to the upstream.
+// Tracestate is forwarded as is along with the other headers.
+func (p *retryPlugin) startSpan(areq *http.Request, parent SpanContext, attempt int) *Span {
+	span := p.tracer.Start(parent, "retry attempt")
+	if span == nil {
 		return nil
 	}
 
-	pl, err := ParsePolicy(ph)
+	span.SetString("retry.middleware", p.name)
+	span.SetString("http.request.method", areq.Method)
+	span.SetInt("retry.attempt", attempt)
+
+	areq.Header.Set("Traceparent", span.Context().String())
+
+	return span
+}
+
+func endSpan(span *Span, status int, failed, retrying bool, reason, stopped string) {
+	if status != 0 {
+		span.SetInt("http.response.status_code", status)
+	}
+
+	if retrying && reason != "" {
+		span.SetString("retry.reason", reason)
+	}
+
+	if stopped != "" {
+		span.SetString("retry.stopped", stopped)
+	}
+
+	if failed {
+		span.SetFailed()
+	}
+
+	span.End()
+}
+
+// hedgeReason tells why a hedged attempt was not committed: the reason of its failure, or another one won.
+func hedgeReason(failed string) string {
+	if failed != "" {
+		return failed
+	}
+
+	return "hedged"
+}
+
+func (p *retryPlugin) logAttempt(pl *RetryPolicy, rrw *RetryResponseWriter, attempt int) {
+	// every request is logged, the policy isn't formatted unless it's written
+	if !p.log.Enabled(LevelDebug) {
+		return
+	}
+
+	switch {
+	case rrw.Stopped() != "":
+		p.log.Debug("retries stopped", "attempt", attempt, "status", rrw.Status(), "reason", rrw.Stopped(),
+			"policy", pl.String())
+	case rrw.Retrying:
+		p.log.Debug("attempt failed", "attempt", attempt, "status", rrw.Status(), "delay", rrw.Delay.String())
+	default:
+		p.log.Debug("attempt served", "attempt", attempt, "status", rrw.Status())
+	}
+}
+
+// attemptRequest derives the request of the attempt, bound by the per try timeout
+// and traced when the policy classifies failures.
+func attemptRequest(req *http.Request, pl *RetryPolicy, a *Attempt) (*http.Request, context.CancelFunc) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+
+	if t := pl.PerTryTimeout(); t > 0 {
+		parent := req.Context()
+
+		tctx, tcancel := context.WithTimeout(parent, t)
+		a.TimedOut = func() bool {
+			return tctx.Err() == context.DeadlineExceeded && parent.Err() == nil
+		}
+
+		ctx, cancel = tctx, tcancel
+	}
+
+	if pl.HandlesFailures() {
+		a.Trace = NewAttemptTrace()
+		ctx = a.Trace.WithContext(ctx)
+	}
+
+	if ctx == req.Context() {
+		return req, cancel
+	}
+
+	return req.WithContext(ctx), cancel
+}
+
+func (p *retryPlugin) policyFrom(req *http.Request) *RetryPolicy {
+	if req.Header.Get("Retry-Policy") == "" {
+		return p.policy
+	}
+
+	ph, err := NewStructuredHeader(req.Header).Dictionary("Retry-Policy")
 	if err != nil {
-		fmt.Printf("traefikretryplugin.policyFrom: error parsing policy: %s\n", err)
-		return nil
+		p.log.Warn("can't read policy header as dictionary", "error", err)
+		return p.policy
+	}
+
+	pl, err := ParsePolicy(ph, p.policy)
+	if err != nil {
+		p.log.Warn("can't parse policy header", "error", err)
+		return p.policy
 	}
 
 	return pl
 }
 
-func copyBody(rw http.ResponseWriter, req *http.Request, reader *bytes.Reader) error {
-	_, err := reader.Seek(0, 0)
+func copyBody(rw http.ResponseWriter, req *http.Request, reader io.ReadSeeker) error {
+	_, err := reader.Seek(0, io.SeekStart)
 	if err != nil {
 		internalServerError(rw)
 		return err
@@ -103,33 +740,161 @@ func copyBody(rw http.ResponseWriter, req *http.Request, reader *bytes.Reader) e
 	return nil
 }
 
+func wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// serveLargeBody handles a body over the limit either by rejecting it or by streaming it
+// to the next handler without retries. The already buffered part is sent first.
+func (p *retryPlugin) serveLargeBody(rw http.ResponseWriter, req *http.Request, buffered io.Reader) {
+	if p.rejectLargeBody {
+		requestEntityTooLarge(rw)
+		return
+	}
+
+	if buffered != nil {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(buffered, req.Body), req.Body}
+	}
+
+	p.next.ServeHTTP(rw, req)
+}
+
+// fixContentLength turns a chunked request into a fixed-length one once its body is buffered,
+// so every attempt sends the same framing.
+func fixContentLength(req *http.Request, body io.Seeker) error {
+	if req.ContentLength >= 0 {
+		return nil
+	}
+
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("traefikretryplugin.fixContentLength: can't get body size: %w", err)
+	}
+
+	req.ContentLength = size
+	req.TransferEncoding = nil
+	req.Header.Del("Transfer-Encoding")
+	req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+
+	return nil
+}
+
 func internalServerError(rw http.ResponseWriter) {
 	http.Error(rw, "Internal Server Error", 500)
 }
 
-func bufferBody(buffer []byte, req *http.Request) (*bytes.Reader, error) {
-L:
-	for {
-		if len(buffer) == cap(buffer) {
-			buffer = append(buffer, 0)[:len(buffer)]
-		}
+func serviceUnavailable(rw http.ResponseWriter) {
+	http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+}
+
+func requestEntityTooLarge(rw http.ResponseWriter) {
+	http.Error(rw, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+}
 
-		n, err := req.Body.Read(buffer[len(buffer):cap(buffer)])
-		buffer = buffer[:len(buffer)+n]
+var errBodyTooLarge = errors.New("body is too large")
 
-		switch {
-		case err == io.EOF:
-			break L
-		case err != nil:
-			return nil, fmt.Errorf("traefikretryplugin.bufferBody: can't buffer body: %w", err)
+// readBody buffers the body in memory up to memoryBodySize and spills the rest to a temporary file.
+// The returned reader must be closed when it implements io.Closer.
+func (p *retryPlugin) readBody(buffer *bytes.Buffer, req *http.Request) (io.ReadSeeker, error) {
+	if p.memoryBodySize == 0 || p.maxBodySize > 0 && p.memoryBodySize >= p.maxBodySize {
+		rdr, err := bufferBody(buffer, req, p.maxBodySize)
+		if rdr == nil {
+			return nil, err
 		}
+
+		return rdr, err
+	}
+
+	rdr, err := bufferBody(buffer, req, p.memoryBodySize)
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return p.spillBody(rdr, req)
+	case err != nil:
+		return nil, err
+	}
+
+	return rdr, nil
+}
+
+// spillBody writes the buffered part and the rest of the body to a temporary file.
+// A body over the limit or the disk quota is reported with errBodyTooLarge along with the spilled part,
+// the part left unspilled is put back in the request.
+func (p *retryPlugin) spillBody(buffered io.Reader, req *http.Request) (io.ReadSeeker, error) {
+	sf, err := NewSpillFile(p.tempDir, p.diskQuota)
+	if err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.spillBody: %w", err)
+	}
+
+	var body io.Reader = io.MultiReader(buffered, req.Body)
+	if p.maxBodySize > 0 {
+		body = io.LimitReader(body, p.maxBodySize+1)
+	}
+
+	_, err = sf.ReadFrom(body)
+	if err != nil && !errors.Is(err, ErrQuotaExceeded) {
+		_ = sf.Close()
+
+		return nil, fmt.Errorf("traefikretryplugin.spillBody: can't spill body: %w", err)
+	}
+
+	if _, serr := sf.Seek(0, io.SeekStart); serr != nil {
+		_ = sf.Close()
+
+		return nil, fmt.Errorf("traefikretryplugin.spillBody: %w", serr)
+	}
+
+	if err != nil || p.maxBodySize > 0 && sf.Size() > p.maxBodySize {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(buffered, req.Body), req.Body}
+
+		return sf, fmt.Errorf("traefikretryplugin.spillBody: %w", errBodyTooLarge)
+	}
+
+	return sf, nil
+}
+
+// bufferBody reads the body up to the limit, zero means no limit. When the body exceeds the limit
+// errBodyTooLarge is returned along with the buffered part, the rest stays unread in the request.
+func bufferBody(buffer *bytes.Buffer, req *http.Request, limit int64) (*bytes.Reader, error) {
+	var body io.Reader = req.Body
+	if limit > 0 {
+		body = io.LimitReader(req.Body, limit+1)
+	}
+
+	// Content-Length is only trusted for preallocation when it's bounded by the limit
+	if req.ContentLength > 0 && (limit > 0 && req.ContentLength <= limit || limit == 0 && req.ContentLength <= maxPooledBufferSize) {
+		buffer.Grow(int(req.ContentLength) + bytes.MinRead)
+	}
+
+	if _, err := buffer.ReadFrom(body); err != nil {
+		return nil, fmt.Errorf("traefikretryplugin.bufferBody: can't buffer body: %w", err)
+	}
+
+	if limit > 0 && int64(buffer.Len()) > limit {
+		return bytes.NewReader(buffer.Bytes()), fmt.Errorf("traefikretryplugin.bufferBody: %w", errBodyTooLarge)
 	}
 
-	return bytes.NewReader(buffer), nil
+	return bytes.NewReader(buffer.Bytes()), nil
 }
 
-func bypass(header http.Header) bool {
+func (p *retryPlugin) bypass(header http.Header) bool {
 	return header.Get("Connection") == "Upgrade" && header.Get("Upgrade") == "websocket" ||
-		header.Get("Transfer-Encoding") == "chunked" ||
-		header.Get("Retry-Policy") == ""
+		header.Get("Retry-Policy") == "" && p.policy == nil
 }
@@ -0,0 +1,481 @@
+package traefikretryplugin
+
+import (
+	"bytes"
+	"context"
+	. "github.com/atidev/traefikretryplugin/internal"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstream records the body and the Content-Length of the requests it serves.
+type upstream struct {
+	body          []byte
+	contentLength string
+}
+
+func (u *upstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	u.body, _ = io.ReadAll(req.Body)
+	u.contentLength = req.Header.Get("Content-Length")
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+func newTestPlugin(t *testing.T, next http.Handler, config *Config) *retryPlugin {
+	t.Helper()
+
+	config.LogLevel = "error"
+
+	h, err := New(context.Background(), next, config, "test")
+	if err != nil {
+		t.Fatalf("New(%+v): %v", config, err)
+	}
+
+	return h.(*retryPlugin)
+}
+
+func TestSpilledBodyOverQuota(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10)
+
+	tests := []struct {
+		name string
+		// used is the part of the quota spilled by the other requests
+		used int
+	}{
+		{name: "quota exceeded while spilling"},
+		{name: "quota exhausted", used: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &upstream{}
+			p := newTestPlugin(t, u, &Config{
+				Codes:          "5xx",
+				Attempts:       2,
+				MemoryBodySize: 10,
+				DiskQuota:      1,
+				TempDir:        t.TempDir(),
+			})
+
+			if tt.used > 0 {
+				sf, err := NewSpillFile(t.TempDir(), p.diskQuota)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				defer sf.Close()
+
+				// the reader isn't drained, the quota is exceeded before its EOF
+				_, _ = sf.ReadFrom(strings.NewReader(strings.Repeat("x", tt.used)))
+
+				if sf.Size() != int64(tt.used) {
+					t.Fatalf("spilled %d bytes, want %d", sf.Size(), tt.used)
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/", bytes.NewReader(body))
+			req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+			p.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !bytes.Equal(u.body, body) {
+				t.Errorf("upstream got %d bytes %q, want %d bytes", len(u.body), u.body, len(body))
+			}
+
+			if u.contentLength != strconv.Itoa(len(body)) {
+				t.Errorf("Content-Length = %s, want %d", u.contentLength, len(body))
+			}
+		})
+	}
+}
+
+func TestSpilledBodyOverLimit(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10)
+	u := &upstream{}
+	p := newTestPlugin(t, u, &Config{
+		Codes:          "5xx",
+		Attempts:       2,
+		MaxBodySize:    50,
+		MemoryBodySize: 10,
+		TempDir:        t.TempDir(),
+	})
+
+	// the chunked body isn't caught by the Content-Length check
+	req := httptest.NewRequest(http.MethodPut, "/", io.MultiReader(bytes.NewReader(body)))
+	req.ContentLength = -1
+
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !bytes.Equal(u.body, body) {
+		t.Errorf("upstream got %d bytes %q, want %d bytes", len(u.body), u.body, len(body))
+	}
+}
+
+// bufferBodySlice is the former bufferBody growing a pooled []byte, kept to compare the allocations.
+func bufferBodySlice(buffer []byte, req *http.Request) ([]byte, error) {
+	for {
+		if len(buffer) == cap(buffer) {
+			buffer = append(buffer, 0)[:len(buffer)]
+		}
+
+		n, err := req.Body.Read(buffer[len(buffer):cap(buffer)])
+		buffer = buffer[:len(buffer)+n]
+
+		switch {
+		case err == io.EOF:
+			return buffer, nil
+		case err != nil:
+			return nil, err
+		}
+	}
+}
+
+var benchmarkBodySizes = []int{512, 20 * 1024, 256 * 1024}
+
+func BenchmarkBufferBody(b *testing.B) {
+	for _, size := range benchmarkBodySizes {
+		data := bytes.Repeat([]byte("x"), size)
+		body := bytes.NewReader(data)
+		req := httptest.NewRequest(http.MethodPut, "/", io.NopCloser(body))
+
+		b.Run("slice/"+strconv.Itoa(size), func(b *testing.B) {
+			pool := sync.Pool{New: func() interface{} { return make([]byte, 0, 512) }}
+
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				body.Reset(data)
+
+				// like the former ServeHTTP, the slice is put back as it was taken, its growth is lost
+				bb := pool.Get().([]byte)
+
+				if _, err := bufferBodySlice(bb, req); err != nil {
+					b.Fatal(err)
+				}
+
+				pool.Put(bb[:0])
+			}
+		})
+
+		b.Run("buffer/"+strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				body.Reset(data)
+
+				bb := getBuffer()
+
+				if _, err := bufferBody(bb, req, 0); err != nil {
+					b.Fatal(err)
+				}
+
+				putBuffer(bb)
+			}
+		})
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	h, err := New(context.Background(), next, &Config{Codes: "5xx", Attempts: 3, LogLevel: "error"}, "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range benchmarkBodySizes {
+		body := bytes.Repeat([]byte("x"), size)
+
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPut, "/", bytes.NewReader(body))
+
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+func TestBreakerProbeOverBodyLimit(t *testing.T) {
+	u := &upstream{}
+	p := newTestPlugin(t, u, &Config{
+		Codes:               "5xx",
+		Attempts:            2,
+		MaxBodySize:         10,
+		BreakerFailureRatio: 0.5,
+		BreakerMinAttempts:  1,
+		BreakerOpenDuration: "1ms",
+		BreakerMode:         "fail-fast",
+	})
+
+	p.breaker.Record(true)
+	time.Sleep(2 * time.Millisecond)
+
+	// neither body reaches the upstream through the retries, so neither takes the probe
+	for _, contentLength := range []int64{100, -1} {
+		req := httptest.NewRequest(http.MethodPut, "/", bytes.NewReader(make([]byte, 100)))
+		req.ContentLength = contentLength
+
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d, want the probe let through", rec.Code)
+	}
+}
+
+func TestMetricsPath(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		if calls == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	p := newTestPlugin(t, next, &Config{Codes: "5xx", Attempts: 2, MetricsPath: "/_retry/metrics"})
+
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/_retry/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 2 {
+		t.Errorf("upstream called %d times, want the metrics path answered by the plugin", calls)
+	}
+
+	for _, sample := range []string{
+		`traefik_retry_requests_total{middleware="test"} 1`,
+		`traefik_retry_retries_total{middleware="test",code="503"} 1`,
+		`traefik_retry_exhausted_total{middleware="test"} 0`,
+		`traefik_retry_attempts_bucket{middleware="test",le="1"} 0`,
+		`traefik_retry_attempts_bucket{middleware="test",le="2"} 1`,
+		`traefik_retry_backoff_seconds_count{middleware="test"} 1`,
+	} {
+		if !strings.Contains(string(body), "\n"+sample+"\n") {
+			t.Errorf("missing sample %s", sample)
+		}
+	}
+}
+
+func TestTraceparentPropagation(t *testing.T) {
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	var traceparents []string
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		traceparents = append(traceparents, req.Header.Get("Traceparent"))
+
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	collector := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer collector.Close()
+
+	p := newTestPlugin(t, next, &Config{Codes: "5xx", Attempts: 1, TracingEndpoint: collector.URL})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Traceparent", parent)
+
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(traceparents) != 2 || traceparents[0] == traceparents[1] {
+		t.Fatalf("upstream got %q, want a span per attempt", traceparents)
+	}
+
+	for _, v := range traceparents {
+		sc, ok := ParseTraceparent(v)
+		if !ok || sc.String()[:36] != parent[:36] || sc.String() == parent || !sc.Sampled() {
+			t.Errorf("upstream got %s, want a child of %s", v, parent)
+		}
+	}
+}
+
+func TestGRPCMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []string
+		status  int
+		grpc    string
+		calls   int
+	}{
+		{name: "grpc-status of excluded method", status: http.StatusOK, grpc: "14", calls: 2},
+		{name: "status of excluded method", status: http.StatusServiceUnavailable, calls: 1},
+		{name: "status of allowed method", methods: []string{http.MethodPost}, status: http.StatusServiceUnavailable, calls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.Header().Set("Content-Type", "application/grpc")
+				rw.WriteHeader(tt.status)
+				_, _ = rw.Write([]byte("message"))
+
+				if tt.grpc != "" {
+					rw.Header().Set(http.TrailerPrefix+"Grpc-Status", tt.grpc)
+				}
+			})
+
+			p := newTestPlugin(t, next, &Config{
+				Codes:     "5xx",
+				Attempts:  1,
+				Methods:   tt.methods,
+				GrpcCodes: []string{"unavailable"},
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", strings.NewReader("request"))
+			req.Header.Set("Content-Type", "application/grpc")
+
+			p.ServeHTTP(httptest.NewRecorder(), req)
+
+			if calls != tt.calls {
+				t.Errorf("upstream called %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+
+	if err := wait(ctx, time.Minute); err != context.Canceled {
+		t.Errorf("wait() = %v, want %v", err, context.Canceled)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("wait() returned after %s, want as soon as cancelled", d)
+	}
+
+	if err := wait(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("wait() = %v", err)
+	}
+}
+
+func TestRetryStoppedByBudget(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	// a percent of a single request allows one retry
+	p := newTestPlugin(t, next, &Config{Codes: "5xx", Attempts: 3, BudgetPercent: 1, BudgetWindow: "1m"})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if calls != 2 || rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d after %d calls, want 503 after 2", rec.Code, calls)
+	}
+
+	if v := rec.Header().Get("Retry-Stopped"); v != "budget" {
+		t.Errorf("Retry-Stopped = %q, want budget", v)
+	}
+}
+
+func TestRetryInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     string
+	}{
+		{name: "first attempt", statuses: []int{http.StatusOK}, want: "attempts=1, discarded=(), backoff=0.0, stopped=success"},
+		{name: "success", statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, want: "attempts=3, discarded=(503 502), backoff=0.0, stopped=success"},
+		{name: "exhausted", statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}, want: "attempts=3, discarded=(503 503), backoff=0.0, stopped=exhausted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(tt.statuses[calls])
+				calls++
+			})
+
+			p := newTestPlugin(t, next, &Config{Codes: "5xx", Attempts: 2, RetryInfo: true})
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if v := rec.Header().Get("Retry-Info"); v != tt.want {
+				t.Errorf("Retry-Info = %s, want %s", v, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCServerStreaming(t *testing.T) {
+	rec := httptest.NewRecorder()
+	calls := 0
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.WriteHeader(http.StatusOK)
+
+		for _, message := range []string{"first", "second"} {
+			_, _ = rw.Write([]byte(message))
+			rw.(http.Flusher).Flush()
+
+			// the client gets each message as soon as it's flushed
+			if !strings.HasSuffix(rec.Body.String(), message) {
+				t.Errorf("body %q after flushing %s, want the message sent", rec.Body.String(), message)
+			}
+		}
+
+		rw.Header().Set(http.TrailerPrefix+"Grpc-Status", "14")
+	})
+
+	p := newTestPlugin(t, next, &Config{Codes: "5xx", Attempts: 1, GrpcCodes: []string{"unavailable"}})
+
+	req := httptest.NewRequest(http.MethodPost, "/pkg.Service/Stream", strings.NewReader("request"))
+	req.Header.Set("Content-Type", "application/grpc")
+
+	p.ServeHTTP(rec, req)
+
+	if calls != 1 || rec.Body.String() != "firstsecond" {
+		t.Errorf("upstream called %d times, body %q, want the stream committed once flushed", calls, rec.Body.String())
+	}
+}